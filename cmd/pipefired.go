@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	_ "expvar"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
@@ -20,6 +22,10 @@ import (
 
 const version string = "0.9.13"
 
+// exitDeclarationError is the exit status when the broker refuses the queue declarations,
+// pipefired.service doesn't restart on it
+const exitDeclarationError = 2
+
 func main() {
 
 	log.Infof("PipeFire Daemon Started. Version : %s ", version)
@@ -59,6 +65,16 @@ func executePipelines() {
 		log.Fatal(err.Error())
 	}
 
+	if c.MetricsAddr != "" {
+		// expvar publishes the metrics at /debug/vars
+		go func() {
+			log.Infof("Metrics available at http://%s/debug/vars", c.MetricsAddr)
+			if err := http.ListenAndServe(c.MetricsAddr, nil); err != nil {
+				log.Errorf("Unable to serve metrics: %s", err.Error())
+			}
+		}()
+	}
+
 	selectedConfig := hostConfig.ConfigFileUsed()
 	selectedDir := path.Dir(selectedConfig)
 	log.Infof("Using %s", selectedConfig)
@@ -92,9 +108,15 @@ func executePipelines() {
 
 			go directDebitPipeline.StartListener(listenerError)
 			err := <-listenerError
-
-			log.Warningf("RabbitMQ Reconnect Required: %s", err)
-			time.Sleep(2 * time.Second)
+			if directdebit.IsDeclarationError(err) {
+				// the broker will keep refusing the queue until it's migrated
+				log.Errorf("RabbitMQ configuration doesn't match the broker, not reconnecting: %s", err)
+				os.Exit(exitDeclarationError)
+			}
+
+			delay := directDebitPipeline.ReconnectDelay()
+			log.Warningf("RabbitMQ Reconnect Required: %s. Reconnecting in %s", err, delay)
+			time.Sleep(delay)
 		}
 	}
 
@@ -0,0 +1,6 @@
+ALTER TABLE TransferRecord
+    ADD COLUMN `verification_method` VARCHAR(32) COMMENT 'How the remote file was verified: size, readBack or checksum' AFTER `correlation_id`,
+    ADD COLUMN `verified_file_hash` VARCHAR(254) COMMENT 'Hash of the remote file after the transfer' AFTER `verification_method`,
+    ADD COLUMN `verified` BOOLEAN NOT NULL DEFAULT FALSE COMMENT 'The remote file matches the local file' AFTER `verified_file_hash`,
+    ADD COLUMN `verified_at` DATETIME COMMENT 'Date and time the remote file was verified' AFTER `verified`,
+    ADD COLUMN `verification_errors` TEXT COMMENT 'Verification Errors' AFTER `verified_at`;
@@ -18,6 +18,11 @@ CREATE TABLE TransferRecord (
     `transfer_end`     DATETIME COMMENT 'Date and time transfer process started',
     `transfer_errors`  TEXT COMMENT 'Transfer Errors',
     `correlation_id`    VARCHAR(254) COMMENT 'CorrelationId',
+    `verification_method` VARCHAR(32) COMMENT 'How the remote file was verified: size, readBack or checksum',
+    `verified_file_hash` VARCHAR(254) COMMENT 'Hash of the remote file after the transfer',
+    `verified`         BOOLEAN NOT NULL DEFAULT FALSE COMMENT 'The remote file matches the local file',
+    `verified_at`      DATETIME COMMENT 'Date and time the remote file was verified',
+    `verification_errors` TEXT COMMENT 'Verification Errors',
     `created_at`       DATETIME NOT NULL COMMENT "Date record was added",
     `updated_at`       DATETIME COMMENT "Date record was updated",
     `deleted_at`       DATETIME COMMENT "Date record was remoted",
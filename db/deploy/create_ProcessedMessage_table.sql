@@ -0,0 +1,21 @@
+
+DROP TABLE IF EXISTS ProcessedMessage;
+CREATE TABLE ProcessedMessage (
+    `id` int AUTO_INCREMENT  PRIMARY KEY,
+    `correlation_id`   VARCHAR(254) NOT NULL COMMENT 'CorrelationId of the trigger message',
+    `message_id`       VARCHAR(254) COMMENT 'AMQP message id',
+    `message_type`     TEXT COMMENT 'Message type of the trigger message',
+    `task`             VARCHAR(254) COMMENT 'Task requested by the trigger message',
+    `status`           VARCHAR(32) NOT NULL COMMENT 'in_progress, succeeded or failed',
+    `attempts`         INT NOT NULL DEFAULT 0 COMMENT 'Number of runs for this message',
+    `local_host_id`    TEXT COMMENT 'Host identifier of the system processing the message',
+    `run_start`        DATETIME COMMENT 'Date and time the last run started',
+    `run_end`          DATETIME COMMENT 'Date and time the last run finished',
+    `run_errors`       TEXT COMMENT 'Errors from the last run',
+    `created_at`       DATETIME NOT NULL COMMENT "Date record was added",
+    `updated_at`       DATETIME COMMENT "Date record was updated",
+    `deleted_at`       DATETIME COMMENT "Date record was remoted",
+
+    UNIQUE INDEX pk_correlation_id USING HASH (correlation_id)
+
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,51 @@
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+//Policy describes an exponential backoff
+type Policy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Jitter randomly spreads the delay by up to this fraction of it i.e 0.2 is +/- 20%
+	Jitter float64
+}
+
+//Delay returns how long to wait before the given attempt.
+//The first retry is attempt 1 and waits for the Initial duration
+func (p Policy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	delay := float64(p.Initial) * math.Pow(multiplier, float64(attempt-1))
+	if p.Max > 0 && delay > float64(p.Max) {
+		return p.Max
+	}
+	return time.Duration(delay)
+}
+
+//JitteredDelay returns the Delay for the attempt randomly adjusted by the Jitter
+//so that clients don't all retry at the same time
+func (p Policy) JitteredDelay(attempt int) time.Duration {
+	delay := float64(p.Delay(attempt))
+	if p.Jitter <= 0 {
+		return time.Duration(delay)
+	}
+
+	jitter := math.Min(p.Jitter, 1)
+	delay = delay + delay*jitter*(rand.Float64()*2-1)
+	if p.Max > 0 && delay > float64(p.Max) {
+		return p.Max
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,64 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	policy := Policy{
+		Initial:    time.Second,
+		Max:        10 * time.Second,
+		Multiplier: 2,
+	}
+
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+
+	for i, e := range expected {
+		if d := policy.Delay(i + 1); d != e {
+			t.Errorf("Attempt %d: expected delay of %s got %s", i+1, e, d)
+		}
+	}
+}
+
+func TestDelayDefaultMultiplier(t *testing.T) {
+	policy := Policy{
+		Initial: time.Second,
+	}
+
+	if d := policy.Delay(3); d != 4*time.Second {
+		t.Errorf("Expected delay of 4s got %s", d)
+	}
+}
+
+func TestJitteredDelay(t *testing.T) {
+	policy := Policy{
+		Initial:    10 * time.Second,
+		Max:        time.Minute,
+		Multiplier: 2,
+		Jitter:     0.5,
+	}
+
+	for i := 0; i < 100; i++ {
+		d := policy.JitteredDelay(1)
+		if d < 5*time.Second || d > 15*time.Second {
+			t.Fatalf("Delay of %s is outside of the jitter range", d)
+		}
+
+		if d = policy.JitteredDelay(10); d > time.Minute {
+			t.Fatalf("Delay of %s is more than the maximum", d)
+		}
+	}
+
+	policy.Jitter = 0
+	if d := policy.JitteredDelay(2); d != 20*time.Second {
+		t.Errorf("Expected no jitter, got %s", d)
+	}
+}
@@ -9,6 +9,8 @@ type HostConfig struct {
 	LogLevel   string            `json:"loglevel"`
 	Background bool              `json:"background"`
 	Pipelines  map[string]string `json:"pipelines"`
+	// MetricsAddr serves the metrics over http i.e 127.0.0.1:9090
+	MetricsAddr string `json:"metricsAddr"`
 }
 type includeFile string
 
@@ -2,6 +2,8 @@ package crypto
 
 import (
 	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -37,6 +39,7 @@ type ProviderConfig struct {
 //Provider helper functions to encrypt/decrypt files
 type Provider interface {
 	EncryptFile(string, string) error
+	EncryptFileWithHash(string, string) (string, error)
 	DecryptFile(string, string) error
 	GetEncryptionKey() (encryptionKey *openpgp.Entity, err error)
 	GetSigningKey() (signingKey *openpgp.Entity, err error)
@@ -106,6 +109,13 @@ func (p provider) GetSigningKey() (signingKey *openpgp.Entity, err error) {
 
 //EncryptFile provides a simple wrapper to encrypt a file
 func (p provider) EncryptFile(plainTextFile string, outputFile string) (err error) {
+	_, err = p.EncryptFileWithHash(plainTextFile, outputFile)
+	return
+}
+
+//EncryptFileWithHash encrypts the file and provides the SHA256 of the encrypted file.
+//The hash is calculated as the file is written so it doesn't need to be read again
+func (p provider) EncryptFileWithHash(plainTextFile string, outputFile string) (hash string, err error) {
 	p.log.Debugf("Encrypting file %s", plainTextFile)
 	p.log.Debugf("Output file %s", outputFile)
 	p.log.Debugf("Using EncryptionKey %s ", p.config.EncryptionKey)
@@ -123,13 +133,15 @@ func (p provider) EncryptFile(plainTextFile string, outputFile string) (err erro
 
 	inFile, err := os.Open(plainTextFile)
 	if err != nil {
-		return err
+		return
 	}
+	defer inFile.Close()
 
 	outFile, err := os.Create(outputFile)
 	if err != nil {
-		return err
+		return
 	}
+	defer outFile.Close()
 
 	p.log.Debug("Performing Encryption ")
 
@@ -146,9 +158,11 @@ func (p provider) EncryptFile(plainTextFile string, outputFile string) (err erro
 
 	// @todo currently uses defaults, should we provide other encryption options?
 	recipientKeys := []*openpgp.Entity{recipientKey}
-	wc, err := openpgp.Encrypt(outFile, recipientKeys, signingKey, hints, packConfig)
+	// hash the encrypted output as it's written
+	hashWriter := sha256.New()
+	wc, err := openpgp.Encrypt(io.MultiWriter(outFile, hashWriter), recipientKeys, signingKey, hints, packConfig)
 	if err != nil {
-		return err
+		return
 	}
 
 	bytes, err := io.Copy(wc, inFile)
@@ -157,22 +171,22 @@ func (p provider) EncryptFile(plainTextFile string, outputFile string) (err erro
 	err = wc.Close()
 	if err != nil {
 		p.log.Errorf("Error Closing pgp writer : %s", err.Error())
-		return err
+		return
 	}
 
 	s, err := os.Stat(plainTextFile)
 	if err != nil {
-		return err
+		return
 	}
 
 	p.log.Debug("Comparing Encrypted bytes with bytes written to disk")
 	if s.Size() != bytes {
-		return fmt.Errorf("File size of : %d does not equal the %d bytes encrypted", s.Size(), bytes)
+		return "", fmt.Errorf("File size of : %d does not equal the %d bytes encrypted", s.Size(), bytes)
 	}
 
 	p.log.Debugf("Encrypted file to %s", plainTextFile)
 
-	return
+	return hex.EncodeToString(hashWriter.Sum(nil)), nil
 }
 
 func (p provider) decryptArmoredKey(fileName string, password string) (*openpgp.Entity, error) {
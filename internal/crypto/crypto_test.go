@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// writePublicKey generates a key for the test, the sample keys in testdata can't be
+// used for encryption
+func writePublicKey(t *testing.T, fileName string) {
+	entity, err := openpgp.NewEntity("pipefire", "test", "pipefire@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptFileWithHash(t *testing.T) {
+	dir := t.TempDir()
+	publicKey := filepath.Join(dir, "public.asc")
+	writePublicKey(t, publicKey)
+
+	provider := NewProvider(ProviderConfig{
+		EncryptionKey: publicKey,
+	}, log.WithField("test", "encrypt"))
+
+	encryptedFile := filepath.Join(dir, "test-file.txt.gpg")
+	hash, err := provider.EncryptFileWithHash("./testdata/test-file.txt", encryptedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same hash as reading the encrypted file again
+	expected, err := HashFile(encryptedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != expected {
+		t.Errorf("Hash %s does not match the hash of the encrypted file %s", hash, expected)
+	}
+}
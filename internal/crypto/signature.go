@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+//VerifyHMAC checks the hex encoded HMAC-SHA256 signature of the message
+//using the shared secret stored in keyFile
+func VerifyHMAC(keyFile string, message []byte, signature string) error {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read the HMAC key: %s", err.Error())
+	}
+
+	expected, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return fmt.Errorf("Signature is not hex encoded: %s", err.Error())
+	}
+
+	mac := hmac.New(sha256.New, []byte(strings.TrimSpace(string(key))))
+	mac.Write(message)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("HMAC signature does not match")
+	}
+	return nil
+}
+
+//VerifyDetachedSignature checks the ASCII armoured PGP signature of the message
+//was made by a key in the ASCII armoured publicKeyFile
+func VerifyDetachedSignature(publicKeyFile string, message []byte, armoredSignature string) (*openpgp.Entity, error) {
+	f, err := os.Open(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keyRing, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the public key %s. Make sure it's ASCII Armoured (not binary): %s", publicKeyFile, err.Error())
+	}
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyRing, strings.NewReader(string(message)), strings.NewReader(armoredSignature))
+	if err != nil {
+		return nil, fmt.Errorf("PGP signature is not valid: %s", err.Error())
+	}
+	return signer, nil
+}
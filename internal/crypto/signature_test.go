@@ -0,0 +1,69 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestVerifyHMAC(t *testing.T) {
+	keyFile, err := ioutil.TempFile("/tmp/", "pipefire_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.WriteString("secret\n")
+	keyFile.Close()
+
+	message := []byte(`{"message":{"task":"transfer"}}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(message)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if err := VerifyHMAC(keyFile.Name(), message, signature); err != nil {
+		t.Error(err)
+	}
+
+	if err := VerifyHMAC(keyFile.Name(), []byte(`{"message":{"task":"resend"}}`), signature); err == nil {
+		t.Error("Expected a modified message to fail verification")
+	}
+}
+
+func TestVerifyDetachedSignature(t *testing.T) {
+	f, err := os.Open("./testdata/private-signing-key.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := entities[0]
+	if signer.PrivateKey.Encrypted {
+		if err := signer.PrivateKey.Decrypt([]byte("foobar123")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	message := []byte(`{"message":{"task":"transfer"}}`)
+	var signature strings.Builder
+	if err := openpgp.ArmoredDetachSign(&signature, signer, strings.NewReader(string(message)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := VerifyDetachedSignature("./testdata/public-signing-key.asc", message, signature.String()); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := VerifyDetachedSignature("./testdata/sample-pub.asc", message, signature.String()); err == nil {
+		t.Error("Expected a signature from a different key to fail verification")
+	}
+}
@@ -0,0 +1,128 @@
+package sftp
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+//PrivateKey is an additional key to authenticate with. Keys are tried in the order
+//they are listed which allows a new key to be added before the old one is removed
+type PrivateKey struct {
+	Key         string `json:"key"`
+	KeyPassword string `json:"keyPassword"`
+	// Certificate is the OpenSSH user certificate for the key i.e ~/.ssh/id_rsa-cert.pub
+	Certificate string `json:"certificate"`
+}
+
+// authentication holds the auth methods for a connection and the agent
+// connection they use, which needs to be closed once the handshake is done
+type authentication struct {
+	methods []ssh.AuthMethod
+	agent   net.Conn
+}
+
+func (a *authentication) Close() {
+	if a.agent != nil {
+		a.agent.Close()
+	}
+}
+
+// authMethods builds the auth methods for the endpoint. The SSH client only tries
+// each method once so every key, certificate and agent key is offered by a single
+// publickey method, configured keys first followed by the agent
+func authMethods(conf Endpoint, log *log.Entry) (*authentication, error) {
+	auth := &authentication{}
+
+	keys := conf.Keys
+	if len(conf.Key) > 0 {
+		keys = append([]PrivateKey{{Key: conf.Key, KeyPassword: conf.KeyPassword, Certificate: conf.Certificate}}, keys...)
+	}
+
+	var signers []ssh.Signer
+	for _, key := range keys {
+		keySigners, err := privateKeySigners(key)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, keySigners...)
+	}
+
+	var agentClient agent.ExtendedAgent
+	if conf.Agent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, fmt.Errorf("Agent authentication is enabled for %s but SSH_AUTH_SOCK is not set", conf.Host)
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to the ssh-agent at %s: %s", socket, err.Error())
+		}
+		auth.agent = conn
+		agentClient = agent.NewClient(conn)
+	}
+
+	if len(signers) > 0 || agentClient != nil {
+		auth.methods = append(auth.methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			if agentClient == nil {
+				return signers, nil
+			}
+			agentSigners, err := agentClient.Signers()
+			if err != nil {
+				// carry on with the configured keys
+				log.Warnf("Unable to get the keys from the ssh-agent: %s", err.Error())
+				return signers, nil
+			}
+			return append(signers, agentSigners...), nil
+		}))
+	}
+
+	if len(conf.Password) > 0 {
+		auth.methods = append(auth.methods, ssh.Password(conf.Password))
+		if conf.KeyboardInteractive {
+			auth.methods = append(auth.methods, ssh.KeyboardInteractive(answerWithPassword(conf.Password)))
+		}
+	}
+	return auth, nil
+}
+
+// privateKeySigners loads the key, the certificate is offered before the plain key
+func privateKeySigners(conf PrivateKey) ([]ssh.Signer, error) {
+	keyPath, err := expandHome(conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := getPrivateKeySigner(keyPath, conf.KeyPassword)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Certificate == "" {
+		return []ssh.Signer{signer}, nil
+	}
+
+	certPath, err := expandHome(conf.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	certSigner, err := getCertificateSigner(certPath, signer)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+// answerWithPassword answers each keyboard-interactive prompt with the password.
+// Servers send an empty challenge with no questions which is answered with nothing
+func answerWithPassword(password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			answers[i] = password
+		}
+		return answers, nil
+	}
+}
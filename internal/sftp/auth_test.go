@@ -0,0 +1,137 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeUserKey writes a private key and a certificate for it signed by a new CA
+func writeUserKey(t *testing.T, dir string) (string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "pipefire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             userKey,
+		CertType:        ssh.UserCert,
+		KeyId:           "pipefire",
+		ValidPrincipals: []string{"pipefire"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "id_ed25519-cert.pub")
+	if err := ioutil.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return keyPath, certPath
+}
+
+func TestPrivateKeySigners(t *testing.T) {
+	keyPath, certPath := writeUserKey(t, t.TempDir())
+
+	signers, err := privateKeySigners(PrivateKey{Key: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Errorf("Expected only the key without a certificate, got %d signers", len(signers))
+	}
+
+	signers, err = privateKeySigners(PrivateKey{Key: keyPath, Certificate: certPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 {
+		t.Fatalf("Expected the certificate and the key, got %d signers", len(signers))
+	}
+	if _, ok := signers[0].PublicKey().(*ssh.Certificate); !ok {
+		t.Error("Expected the certificate to be offered first")
+	}
+
+	// the certificate needs to be for a user
+	if _, err := privateKeySigners(PrivateKey{Key: keyPath, Certificate: keyPath}); err == nil {
+		t.Error("Expected a private key to be rejected as a certificate")
+	}
+}
+
+func TestAuthMethods(t *testing.T) {
+	logger := log.WithField("test", "auth")
+
+	auth, err := authMethods(Endpoint{Host: "sftp.example.com", Password: "secret"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth.methods) != 1 {
+		t.Errorf("Expected only password authentication, got %d methods", len(auth.methods))
+	}
+
+	auth, err = authMethods(Endpoint{Host: "sftp.example.com", Password: "secret", KeyboardInteractive: true}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth.methods) != 2 {
+		t.Errorf("Expected password and keyboard-interactive authentication, got %d methods", len(auth.methods))
+	}
+
+	// t.Setenv needs go 1.17
+	sock, hadSock := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", "")
+	t.Cleanup(func() {
+		if hadSock {
+			os.Setenv("SSH_AUTH_SOCK", sock)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+	})
+	if _, err := authMethods(Endpoint{Host: "sftp.example.com", Agent: true}, logger); err == nil {
+		t.Error("Expected agent authentication to fail without SSH_AUTH_SOCK")
+	}
+}
+
+func TestAnswerWithPassword(t *testing.T) {
+	challenge := answerWithPassword("secret")
+
+	answers, err := challenge("pipefire", "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 || answers[0] != "secret" {
+		t.Errorf("Expected the password as the answer, got %v", answers)
+	}
+
+	answers, _ = challenge("pipefire", "", nil, nil)
+	if len(answers) != 0 {
+		t.Errorf("Expected no answers without questions, got %v", answers)
+	}
+}
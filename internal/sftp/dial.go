@@ -0,0 +1,102 @@
+package sftp
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// address is the host:port to connect to, 22 if the port isn't set
+func (e Endpoint) address() string {
+	port := e.Port
+	if port == 0 {
+		port = 22
+	}
+	return fmt.Sprintf("%s:%d", e.Host, port)
+}
+
+// dial connects to the endpoint, through each of the jump hosts in turn.
+// The connections to the jump hosts need to stay open while the endpoint is in use
+func dial(conf Endpoint, log *log.Entry) (*ssh.Client, []*ssh.Client, error) {
+	var jumps []*ssh.Client
+	var via *ssh.Client
+
+	for _, jump := range conf.JumpHosts {
+		if jump.UserName == "" {
+			jump.UserName = conf.UserName
+		}
+		client, err := dialHop(via, jump, conf.Proxy, log)
+		if err != nil {
+			closeClients(jumps)
+			return nil, nil, fmt.Errorf("Unable to connect to jump host %s: %s", jump.address(), err.Error())
+		}
+		jumps = append(jumps, client)
+		via = client
+	}
+
+	client, err := dialHop(via, conf, conf.Proxy, log)
+	if err != nil {
+		closeClients(jumps)
+		return nil, nil, err
+	}
+	return client, jumps, nil
+}
+
+// dialHop makes the SSH connection to the host, tunnelled through via or the proxy if
+// there is one. Each host is authenticated and has it's host key checked with it's own settings
+func dialHop(via *ssh.Client, hop Endpoint, proxy *ProxyConfig, log *log.Entry) (*ssh.Client, error) {
+	if hop.Host == "" {
+		return nil, fmt.Errorf("Host has not been set")
+	}
+
+	auth, err := authMethods(hop, log)
+	if err != nil {
+		return nil, err
+	}
+	// the agent is only needed while authenticating
+	defer auth.Close()
+
+	hostKeyCallback, err := hostKeyCallback(hop, log)
+	if err != nil {
+		return nil, err
+	}
+
+	connDetails := &ssh.ClientConfig{
+		User:            hop.UserName,
+		Auth:            auth.methods,
+		HostKeyCallback: hostKeyCallback,
+	}
+	connDetails.SetDefaults()
+
+	address := hop.address()
+	var conn net.Conn
+	switch {
+	case via != nil:
+		log.Infof("Attempting to connect to %s through %s ", address, via.RemoteAddr())
+		conn, err = via.Dial("tcp", address)
+	case proxy != nil && proxy.Address != "":
+		log.Infof("Attempting to connect to %s through the %s proxy %s ", address, proxy.Type, proxy.Address)
+		conn, err = proxy.dial(address)
+	default:
+		log.Infof("Attempting to connect to %s ", address)
+		conn, err = net.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, connDetails)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// closeClients closes the jump host connections, the last one first
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
@@ -0,0 +1,244 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an SSH server which accepts the password, serves SFTP sessions and
+// forwards direct-tcpip channels the way a jump host does
+type testServer struct {
+	endpoint   Endpoint
+	listener   net.Listener
+	config     *ssh.ServerConfig
+	mu         sync.Mutex
+	conns      []net.Conn
+	keepAlives int
+	// active is the number of connections which haven't been closed
+	active int
+}
+
+func newTestServer(t *testing.T, password string) *testServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) != password {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.ParseInt(port, 10, 64)
+
+	s := &testServer{
+		endpoint: Endpoint{
+			Host:                host,
+			Port:                portNumber,
+			UserName:            "pipefire",
+			Password:            password,
+			HostKeyFingerprints: []string{ssh.FingerprintSHA256(hostKey.PublicKey())},
+		},
+		listener: listener,
+		config:   config,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveConn(conn)
+		}
+	}()
+	t.Cleanup(s.close)
+	return s
+}
+
+// startServer runs a test server, the function stops it
+func startServer(t *testing.T, password string) (Endpoint, func()) {
+	s := newTestServer(t, password)
+	return s.endpoint, s.close
+}
+
+func (s *testServer) close() {
+	s.listener.Close()
+	s.dropConnections()
+}
+
+// dropConnections closes the connections as if the server had gone away
+func (s *testServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// keepAliveCount is the number of keepalives the server has received
+func (s *testServer) keepAliveCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keepAlives
+}
+
+// activeCount is the number of connections which are still open
+func (s *testServer) activeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+func (s *testServer) serveConn(conn net.Conn) {
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.active++
+	s.mu.Unlock()
+	go func() {
+		sshConn.Wait()
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+	go func() {
+		for req := range reqs {
+			if req.Type == keepAliveRequest {
+				s.mu.Lock()
+				s.keepAlives++
+				s.mu.Unlock()
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			go serveSftp(newChannel)
+		case "direct-tcpip":
+			forward(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "only session and direct-tcpip are supported")
+		}
+	}
+}
+
+// serveSftp serves the local file system to the sftp subsystem
+func serveSftp(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	for req := range requests {
+		// the payload is the length prefixed name of the subsystem
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			channel.Close()
+			return
+		}
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// forward connects the direct-tcpip channel to the address it asks for
+func forward(newChannel ssh.NewChannel) {
+	// host string, port uint32, originator host string, originator port uint32
+	data := newChannel.ExtraData()
+	hostLength := binary.BigEndian.Uint32(data)
+	host := string(data[4 : 4+hostLength])
+	port := binary.BigEndian.Uint32(data[4+hostLength:])
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		io.Copy(channel, target)
+		channel.Close()
+	}()
+	go func() {
+		io.Copy(target, channel)
+		target.Close()
+	}()
+}
+
+func TestDialThroughJumpHosts(t *testing.T) {
+	logger := log.WithField("test", "dial")
+
+	bastion, stopBastion := startServer(t, "bastion")
+	defer stopBastion()
+	inner, stopInner := startServer(t, "inner")
+	defer stopInner()
+	endpoint, stopEndpoint := startServer(t, "endpoint")
+	defer stopEndpoint()
+
+	endpoint.JumpHosts = []Endpoint{bastion, inner}
+	client, jumps, err := dial(endpoint, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeClients(jumps)
+	defer client.Close()
+
+	if len(jumps) != 2 {
+		t.Errorf("Expected a connection to each jump host, got %d", len(jumps))
+	}
+	if _, _, err := client.SendRequest(keepAliveRequest, true, nil); err != nil {
+		t.Errorf("Expected the tunnelled connection to work: %s", err.Error())
+	}
+
+	// each hop checks it's own host key
+	endpoint.JumpHosts[1].HostKeyFingerprints = bastion.HostKeyFingerprints
+	if _, _, err := dial(endpoint, logger); err == nil {
+		t.Error("Expected the wrong host key for a jump host to be refused")
+	}
+}
@@ -0,0 +1,97 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const fingerprintPrefix = "SHA256:"
+
+// hostKeyCallback verifies the host key presented by the server against the
+// known_hosts file and the pinned fingerprints of the endpoint.
+// Connections are refused if the key can't be verified
+func hostKeyCallback(conf Endpoint, log *log.Entry) (ssh.HostKeyCallback, error) {
+	var knownHostsCallback ssh.HostKeyCallback
+	if conf.KnownHosts != "" {
+		knownHostsFile, err := expandHome(conf.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		knownHostsCallback, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read known_hosts file %s: %s", knownHostsFile, err.Error())
+		}
+	}
+
+	pinned := normaliseFingerprints(conf.HostKeyFingerprints)
+	next := normaliseFingerprints(conf.NextHostKeyFingerprints)
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		if contains(pinned, fingerprint) {
+			log.Debugf("Host key %s %s for %s matches the pinned fingerprint", key.Type(), fingerprint, hostname)
+			return nil
+		}
+
+		if contains(next, fingerprint) {
+			// the server has rotated to the new key
+			log.Warnf("Host %s presented the next host key %s, it should be moved to hostKeyFingerprints", hostname, fingerprint)
+			return nil
+		}
+
+		if knownHostsCallback != nil {
+			err := knownHostsCallback(hostname, remote, key)
+			if err == nil {
+				log.Debugf("Host key %s %s for %s found in %s", key.Type(), fingerprint, hostname, conf.KnownHosts)
+				return nil
+			}
+
+			var keyErr *knownhosts.KeyError
+			if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+				log.Errorf("Host key for %s has changed, %s %s does not match %s", hostname, key.Type(), fingerprint, conf.KnownHosts)
+				return fmt.Errorf("Host key verification failed for %s: %s", hostname, err.Error())
+			}
+		}
+
+		if len(pinned) > 0 || len(next) > 0 {
+			log.Errorf("Host key %s %s for %s does not match the pinned fingerprints", key.Type(), fingerprint, hostname)
+			return fmt.Errorf("Host key verification failed for %s", hostname)
+		}
+
+		// not seen before, log it so it can be verified with the owner of the server and pinned
+		log.Warnf("Unknown host key for %s: %s %s. Add the fingerprint to hostKeyFingerprints or the host to known_hosts once it has been verified", hostname, key.Type(), fingerprint)
+		return fmt.Errorf("Host key for %s is unknown", hostname)
+	}, nil
+}
+
+// normaliseFingerprints ensures the fingerprints are in the SHA256:base64 format used by ssh-keygen -lf
+func normaliseFingerprints(fingerprints []string) []string {
+	normalised := make([]string, 0, len(fingerprints))
+	for _, fp := range fingerprints {
+		fp = strings.TrimRight(strings.TrimSpace(fp), "=")
+		if fp == "" {
+			continue
+		}
+		if !strings.HasPrefix(fp, fingerprintPrefix) {
+			fp = fingerprintPrefix + fp
+		}
+		normalised = append(normalised, fp)
+	}
+	return normalised
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	logger := log.WithField("test", "hostKeys")
+	current := newHostKey(t)
+	next := newHostKey(t)
+	other := newHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("172.20.1.4"), Port: 22}
+	host := "172.20.1.4:22"
+
+	// not configured
+	cb, err := hostKeyCallback(Endpoint{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb(host, remote, current); err == nil {
+		t.Error("Expected unknown host keys to be refused")
+	}
+
+	// pinned fingerprints, with and without the prefix
+	cb, err = hostKeyCallback(Endpoint{
+		HostKeyFingerprints:     []string{ssh.FingerprintSHA256(current)},
+		NextHostKeyFingerprints: []string{strings.TrimPrefix(ssh.FingerprintSHA256(next), fingerprintPrefix) + "="},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb(host, remote, current); err != nil {
+		t.Errorf("Expected the pinned key to be accepted: %s", err.Error())
+	}
+	if err := cb(host, remote, next); err != nil {
+		t.Errorf("Expected the next key to be accepted: %s", err.Error())
+	}
+	if err := cb(host, remote, other); err == nil {
+		t.Error("Expected a key which doesn't match the fingerprints to be refused")
+	}
+
+	// known_hosts
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(host)}, current)
+	if err := ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cb, err = hostKeyCallback(Endpoint{KnownHosts: knownHostsFile}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb(host, remote, current); err != nil {
+		t.Errorf("Expected the key in known_hosts to be accepted: %s", err.Error())
+	}
+	if err := cb(host, remote, other); err == nil {
+		t.Error("Expected a changed host key to be refused")
+	}
+	if err := cb("172.20.1.5:22", remote, current); err == nil {
+		t.Error("Expected a host which isn't in known_hosts to be refused")
+	}
+}
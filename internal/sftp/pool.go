@@ -0,0 +1,398 @@
+package sftp
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultKeepAlive = 30 * time.Second
+
+// keepAliveRequest is the global request OpenSSH uses, servers reply with a failure which is fine
+const keepAliveRequest = "keepalive@openssh.com"
+
+//Pool keeps the connections to each endpoint open for the length of a run so that
+//each task doesn't need to connect again. Connections are checked before they are
+//used and replaced if the server has gone away
+type Pool struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointPool
+	log       *log.Entry
+}
+
+// endpointPool holds the idle connections for a single endpoint
+type endpointPool struct {
+	idle []*liveTransport
+	// sessions limits the number of connections in use when MaxSessions is set
+	sessions chan struct{}
+}
+
+// liveTransport is a connection which is watched for the server going away
+type liveTransport struct {
+	transport
+	done chan struct{}
+	stop chan struct{}
+	err  error
+}
+
+//NewPool creates an empty pool, connections are made as they are needed
+func NewPool(log *log.Entry) *Pool {
+	return &Pool{
+		endpoints: make(map[string]*endpointPool),
+		log:       log,
+	}
+}
+
+//Get provides a connection to the endpoint. Closing the connection returns it to the pool.
+//If the endpoint is already using MaxSessions connections Get waits for one to be returned.
+//A nil pool provides a new connection which is closed as normal
+func (p *Pool) Get(name string, conf Endpoint) (Transport, error) {
+	return p.get(name, conf, false)
+}
+
+//GetNew provides a new connection to the endpoint for servers which expect a connection
+//for each file. It counts towards MaxSessions and is kept alive the same as the pooled
+//connections but closing it disconnects instead of returning it to the pool
+func (p *Pool) GetNew(name string, conf Endpoint) (Transport, error) {
+	return p.get(name, conf, true)
+}
+
+func (p *Pool) get(name string, conf Endpoint, fresh bool) (Transport, error) {
+	if p == nil {
+		return NewConnection(name, conf, log.WithField("sftp", name))
+	}
+
+	key := poolKey(conf)
+	endpoint := p.endpoint(key, conf)
+	if endpoint.sessions != nil {
+		endpoint.sessions <- struct{}{}
+	}
+
+	conn := &pooledTransport{pool: p, key: key, name: name, conf: conf, fresh: fresh}
+	if _, err := conn.connection(); err != nil {
+		conn.release()
+		return nil, err
+	}
+	return conn, nil
+}
+
+//Close disconnects all of the idle connections
+func (p *Pool) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, endpoint := range p.endpoints {
+		for _, conn := range endpoint.idle {
+			conn.close()
+		}
+		endpoint.idle = nil
+		p.log.Debugf("Closed pooled connections to %s", key)
+	}
+}
+
+func (p *Pool) endpoint(key string, conf Endpoint) *endpointPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	endpoint, ok := p.endpoints[key]
+	if !ok {
+		endpoint = &endpointPool{}
+		if conf.MaxSessions > 0 {
+			endpoint.sessions = make(chan struct{}, conf.MaxSessions)
+		}
+		p.endpoints[key] = endpoint
+	}
+	return endpoint
+}
+
+// take provides an idle connection which is still alive, dead connections are discarded
+func (p *Pool) take(key string) *liveTransport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	endpoint := p.endpoints[key]
+	for len(endpoint.idle) > 0 {
+		last := len(endpoint.idle) - 1
+		conn := endpoint.idle[last]
+		endpoint.idle = endpoint.idle[:last]
+		if conn.alive() {
+			return conn
+		}
+		p.log.Warnf("Discarding pooled connection to %s: %v", key, conn.err)
+		conn.close()
+	}
+	return nil
+}
+
+// evict disconnects the idle connections to the endpoint
+func (p *Pool) evict(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	endpoint := p.endpoints[key]
+	for _, conn := range endpoint.idle {
+		conn.close()
+	}
+	endpoint.idle = nil
+}
+
+// put returns the connection to the idle list
+func (p *Pool) put(key string, conn *liveTransport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	endpoint := p.endpoints[key]
+	endpoint.idle = append(endpoint.idle, conn)
+}
+
+// poolKey identifies the endpoint. Connections are only shared by tasks which connect the
+// same way, the settings which only affect transfers are applied each time it's taken
+func poolKey(conf Endpoint) string {
+	connection := conf
+	connection.Upload = nil
+	connection.Resume = nil
+	connection.Verify = nil
+	connection.MaxSessions = 0
+	settings, _ := json.Marshal(connection)
+	sum := sha256.Sum256(settings)
+	return conf.UserName + "@" + conf.address() + "/" + hex.EncodeToString(sum[:4])
+}
+
+// watch waits for the session to end and sends keepalives until it does
+func watch(t transport, keepAlive time.Duration) *liveTransport {
+	conn := &liveTransport{
+		transport: t,
+		done:      make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+
+	go func() {
+		conn.err = t.Session.Wait()
+		close(conn.done)
+	}()
+
+	go func() {
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, _, err := t.Session.SendRequest(keepAliveRequest, true, nil); err != nil {
+					t.log.Warnf("Keepalive to %s failed: %s", t.Name, err.Error())
+					// Wait returns once the session is closed
+					t.Session.Close()
+					return
+				}
+			case <-conn.done:
+				return
+			case <-conn.stop:
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+func (c *liveTransport) alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *liveTransport) close() {
+	close(c.stop)
+	c.transport.Close()
+}
+
+// pooledTransport is a connection borrowed from the pool. Each call checks the
+// session is still alive and reconnects if it isn't
+type pooledTransport struct {
+	pool *Pool
+	key  string
+	name string
+	conf Endpoint
+	conn *liveTransport
+	// fresh connections are never taken from or returned to the pool
+	fresh bool
+}
+
+// connection provides a live connection, reconnecting if the server has closed the last one
+func (c *pooledTransport) connection() (*liveTransport, error) {
+	if c.conn != nil && c.conn.alive() {
+		return c.conn, nil
+	}
+	if c.conn != nil {
+		c.pool.log.Warnf("Connection to %s was lost, reconnecting: %v", c.key, c.conn.err)
+		c.conn.close()
+		c.conn = nil
+	}
+
+	if c.fresh {
+		// idle connections don't hold a session so they would take it over MaxSessions
+		c.pool.evict(c.key)
+	} else {
+		if conn := c.pool.take(c.key); conn != nil {
+			c.pool.log.Debugf("Reusing connection to %s", c.key)
+			// the connection may have been made for a task with different transfer settings
+			conn.Name = c.name
+			conn.conf = c.conf
+			c.conn = conn
+			return conn, nil
+		}
+	}
+
+	t, err := connect(c.name, c.conf, c.pool.log)
+	if err != nil {
+		return nil, err
+	}
+
+	keepAlive := defaultKeepAlive
+	if c.conf.KeepAlive > 0 {
+		keepAlive = time.Duration(c.conf.KeepAlive) * time.Second
+	}
+	c.conn = watch(t, keepAlive)
+	return c.conn, nil
+}
+
+// release gives back the session slot
+func (c *pooledTransport) release() {
+	if endpoint := c.pool.endpoint(c.key, c.conf); endpoint.sessions != nil {
+		<-endpoint.sessions
+	}
+}
+
+//Close returns the connection to the pool, a fresh connection is disconnected
+func (c *pooledTransport) Close() {
+	if c.conn != nil {
+		if c.conn.alive() && !c.fresh {
+			c.pool.put(c.key, c.conn)
+		} else {
+			c.conn.close()
+		}
+		c.conn = nil
+		c.release()
+	}
+}
+
+//SendFile sends the file using a live connection
+func (c *pooledTransport) SendFile(localPath string, remotePath string) (*FileTransferConfirmation, error) {
+	conn, err := c.connection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.SendFile(localPath, remotePath)
+}
+
+//SendDir sends the directory using a live connection
+func (c *pooledTransport) SendDir(srcDir string, destDir string) (*list.List, *list.List) {
+	conn, err := c.connection()
+	if err != nil {
+		errorList := list.New()
+		errorList.PushFront(err)
+		return list.New(), errorList
+	}
+	return conn.SendDir(srcDir, destDir)
+}
+
+//ListRemoteDir lists the directory using a live connection
+func (c *pooledTransport) ListRemoteDir(remoteDir string) error {
+	conn, err := c.connection()
+	if err != nil {
+		return err
+	}
+	return conn.ListRemoteDir(remoteDir)
+}
+
+//GetFile collects the file using a live connection
+func (c *pooledTransport) GetFile(remoteFile string, localFile string) (*FileTransferConfirmation, error) {
+	conn, err := c.connection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.GetFile(remoteFile, localFile)
+}
+
+//GetDir collects the directory using a live connection
+func (c *pooledTransport) GetDir(remoteDir string, localDir string) (*list.List, *list.List) {
+	conn, err := c.connection()
+	if err != nil {
+		errorList := list.New()
+		errorList.PushFront(err)
+		return list.New(), errorList
+	}
+	return conn.GetDir(remoteDir, localDir)
+}
+
+//CleanDir cleans the directory using a live connection
+func (c *pooledTransport) CleanDir(remoteDir string) error {
+	conn, err := c.connection()
+	if err != nil {
+		return err
+	}
+	return conn.CleanDir(remoteDir)
+}
+
+//RemoveFetched removes the collected files using a live connection
+func (c *pooledTransport) RemoveFetched(confirmations []*FileTransferConfirmation) error {
+	conn, err := c.connection()
+	if err != nil {
+		return err
+	}
+	return conn.RemoveFetched(confirmations)
+}
+
+//MoveFetched moves the collected files using a live connection
+func (c *pooledTransport) MoveFetched(confirmations []*FileTransferConfirmation, remoteDir string, processedDir string) error {
+	conn, err := c.connection()
+	if err != nil {
+		return err
+	}
+	return conn.MoveFetched(confirmations, remoteDir, processedDir)
+}
+
+//PurgeProcessed removes old processed directories using a live connection
+func (c *pooledTransport) PurgeProcessed(processedRoot string, before time.Time) ([]string, error) {
+	conn, err := c.connection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.PurgeProcessed(processedRoot, before)
+}
+
+//VerifyFile checks the uploaded file using a live connection
+func (c *pooledTransport) VerifyFile(xfer *FileTransferConfirmation) (*Verification, error) {
+	conn, err := c.connection()
+	if err != nil {
+		return &Verification{Method: verifySize}, err
+	}
+	return conn.VerifyFile(xfer)
+}
+
+//RemoveDir removes the directory using a live connection
+func (c *pooledTransport) RemoveDir(remoteDir string) error {
+	conn, err := c.connection()
+	if err != nil {
+		return err
+	}
+	return conn.RemoveDir(remoteDir)
+}
+
+//RemoveFile removes the file using a live connection
+func (c *pooledTransport) RemoveFile(remoteFile string) error {
+	conn, err := c.connection()
+	if err != nil {
+		return err
+	}
+	return conn.RemoveFile(remoteFile)
+}
@@ -0,0 +1,239 @@
+package sftp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestPoolKey(t *testing.T) {
+	conf := Endpoint{Host: "sftp.example.com", UserName: "pipefire"}
+	if key := poolKey(conf); !strings.HasPrefix(key, "pipefire@sftp.example.com:22/") {
+		t.Errorf("Expected the default port in the key, got %s", key)
+	}
+
+	other := Endpoint{Host: "sftp.example.com", UserName: "other", Port: 22}
+	if poolKey(conf) == poolKey(other) {
+		t.Error("Expected a different user to use a different connection")
+	}
+
+	// settings which only affect transfers share the connection
+	transfers := conf
+	transfers.Upload = &UploadConfig{TempSuffix: ".part"}
+	transfers.Verify = &VerifyConfig{ReadBack: true}
+	transfers.Resume = &ResumeConfig{Downloads: true}
+	if poolKey(conf) != poolKey(transfers) {
+		t.Error("Expected transfer settings to share the connection")
+	}
+
+	// connecting another way doesn't
+	proxied := conf
+	proxied.Proxy = &ProxyConfig{Type: "socks5", Address: "proxy:1080"}
+	keyed := conf
+	keyed.Key = "/etc/pipefire/id_rsa"
+	jumped := conf
+	jumped.JumpHosts = []Endpoint{{Host: "bastion"}}
+	for _, c := range []Endpoint{proxied, keyed, jumped} {
+		if poolKey(conf) == poolKey(c) {
+			t.Errorf("Expected a different connection for %+v", c)
+		}
+	}
+}
+
+func TestPoolReleasesSessionOnFailedConnect(t *testing.T) {
+	pool := NewPool(log.WithField("test", "pool"))
+	defer pool.Close()
+
+	// the connection fails, if the session isn't given back the second Get would block
+	conf := Endpoint{UserName: "pipefire", MaxSessions: 1}
+	for i := 0; i < 2; i++ {
+		if _, err := pool.Get("test", conf); err == nil {
+			t.Fatal("Expected the connection to fail without a host")
+		}
+	}
+}
+
+func TestNilPoolClose(t *testing.T) {
+	var pool *Pool
+	pool.Close()
+}
+
+// waitForClose waits for the pooled connection to notice the server has gone away
+func waitForClose(t *testing.T, conn *liveTransport) {
+	select {
+	case <-conn.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be closed")
+	}
+}
+
+func TestPoolReconnects(t *testing.T) {
+	server := newTestServer(t, "secret")
+	pool := NewPool(log.WithField("test", "pool"))
+	defer pool.Close()
+	dir := t.TempDir()
+
+	conn, err := pool.Get("test", server.endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pooled := conn.(*pooledTransport)
+	first := pooled.conn
+
+	server.dropConnections()
+	waitForClose(t, first)
+
+	// the next call connects again
+	if err := conn.ListRemoteDir(dir); err != nil {
+		t.Fatalf("Expected the connection to be replaced: %s", err.Error())
+	}
+	if pooled.conn == first {
+		t.Error("Expected a new connection")
+	}
+	conn.Close()
+
+	// an idle connection which died in the pool isn't handed out again
+	idle := pool.endpoints[poolKey(server.endpoint)].idle[0]
+	server.dropConnections()
+	waitForClose(t, idle)
+
+	conn, err = pool.Get("test", server.endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.(*pooledTransport).conn == idle {
+		t.Error("Expected the dead idle connection to be discarded")
+	}
+	if err := conn.ListRemoteDir(dir); err != nil {
+		t.Errorf("Expected the new connection to work: %s", err.Error())
+	}
+}
+
+func TestPoolSendsKeepAlives(t *testing.T) {
+	server := newTestServer(t, "secret")
+	pool := NewPool(log.WithField("test", "pool"))
+	defer pool.Close()
+
+	conf := server.endpoint
+	conf.KeepAlive = 1
+	conn, err := pool.Get("test", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.keepAliveCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a keepalive to be sent")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !conn.(*pooledTransport).conn.alive() {
+		t.Error("Expected a connection which answers keepalives to stay alive")
+	}
+}
+
+func TestPoolGetNew(t *testing.T) {
+	server := newTestServer(t, "secret")
+	pool := NewPool(log.WithField("test", "pool"))
+	defer pool.Close()
+
+	conf := server.endpoint
+	conf.MaxSessions = 1
+	conn, err := pool.Get("test", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	idle := pool.endpoints[poolKey(conf)].idle[0]
+
+	fresh, err := pool.GetNew("test", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := fresh.(*pooledTransport).conn
+	if first == idle {
+		t.Error("Expected a new connection instead of the idle one")
+	}
+
+	// the idle connection is closed so that the server never sees more than MaxSessions
+	waitForClose(t, idle)
+	waitForActive(t, server, conf.MaxSessions)
+
+	// the new connection holds the only session
+	got := make(chan Transport)
+	go func() {
+		conn, _ := pool.Get("test", conf)
+		got <- conn
+	}()
+	select {
+	case <-got:
+		t.Fatal("Expected Get to wait for the session")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if active := server.activeCount(); active > conf.MaxSessions {
+		t.Errorf("Expected at most %d connections, the server has %d", conf.MaxSessions, active)
+	}
+
+	// closing disconnects rather than returning the connection to the pool
+	fresh.Close()
+	waitForClose(t, first)
+
+	select {
+	case conn := <-got:
+		if conn == nil {
+			t.Fatal("Expected Get to connect once the session was given back")
+		}
+		defer conn.Close()
+		if conn.(*pooledTransport).conn == first {
+			t.Error("Expected Get not to use the closed connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Get to carry on once the session was given back")
+	}
+	waitForActive(t, server, conf.MaxSessions)
+}
+
+// waitForActive waits for the server to see the number of open connections
+func waitForActive(t *testing.T, server *testServer, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for server.activeCount() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d connections, the server has %d", expected, server.activeCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolAppliesTransferSettings(t *testing.T) {
+	server := newTestServer(t, "secret")
+	pool := NewPool(log.WithField("test", "pool"))
+	defer pool.Close()
+
+	conn, err := pool.Get("collect", server.endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := conn.(*pooledTransport).conn
+	conn.Close()
+
+	verified := server.endpoint
+	verified.Verify = &VerifyConfig{ReadBack: true}
+	conn, err = pool.Get("send", verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reused := conn.(*pooledTransport).conn
+	if reused != first {
+		t.Fatal("Expected the idle connection to be reused")
+	}
+	if reused.conf.Verify == nil || reused.Name != "send" {
+		t.Error("Expected the settings of the task which took the connection to be used")
+	}
+}
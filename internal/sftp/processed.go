@@ -0,0 +1,105 @@
+package sftp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//ProcessedDateFormat is the layout of the dated directories under the processed directory
+const ProcessedDateFormat = "2006-01-02"
+
+//MoveFetched moves the remote files which were collected by GetFile or GetDir into processedDir
+//instead of removing them. The directory structure below remoteDir is kept.
+//Files which have changed since they were collected are left in place
+func (c transport) MoveFetched(confirmations []*FileTransferConfirmation, remoteDir string, processedDir string) error {
+	var lastError error
+	for _, xfer := range confirmations {
+		if xfer == nil || xfer.RemoteFileName == "" || xfer.LocalHash == "" {
+			continue
+		}
+		if err := c.moveFetchedFile(xfer, remoteDir, processedDir); err != nil {
+			c.log.Warnf("Not moving %s: %s", xfer.RemoteFileName, err.Error())
+			lastError = err
+		}
+	}
+	return lastError
+}
+
+func (c transport) moveFetchedFile(xfer *FileTransferConfirmation, remoteDir string, processedDir string) error {
+	if err := c.verifyFetched(xfer); err != nil {
+		return err
+	}
+
+	dest := filepath.Join(processedDir, processedPath(remoteDir, xfer.RemoteFileName))
+	if err := c.Client.MkdirAll(filepath.Dir(dest)); err != nil {
+		return fmt.Errorf("Unable to create %s: %s", filepath.Dir(dest), err.Error())
+	}
+
+	if err := c.rename(xfer.RemoteFileName, dest); err != nil {
+		return err
+	}
+	c.log.Debugf("Moved %s to %s", xfer.RemoteFileName, dest)
+	return nil
+}
+
+// processedPath is the path of the file relative to the directory it was collected from
+func processedPath(remoteDir string, remoteFile string) string {
+	rel, err := filepath.Rel(remoteDir, remoteFile)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		// not below the collected directory
+		return filepath.Base(remoteFile)
+	}
+	return rel
+}
+
+//PurgeProcessed removes the dated directories in processedRoot from before the given date.
+//Directories which aren't named after a date are left alone
+func (c transport) PurgeProcessed(processedRoot string, before time.Time) (purged []string, err error) {
+	dirs, err := c.Client.ReadDir(processedRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := before.Format(ProcessedDateFormat)
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(ProcessedDateFormat, dir.Name()); err != nil {
+			continue
+		}
+		// the layout sorts in date order
+		if dir.Name() >= cutoff {
+			continue
+		}
+
+		path := filepath.Join(processedRoot, dir.Name())
+		if err = c.removeAll(path); err != nil {
+			return purged, err
+		}
+		purged = append(purged, path)
+	}
+	return purged, nil
+}
+
+// removeAll removes the remote directory and everything in it
+func (c transport) removeAll(remoteDir string) error {
+	files, err := c.Client.ReadDir(remoteDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(remoteDir, file.Name())
+		if file.IsDir() {
+			err = c.removeAll(path)
+		} else {
+			err = c.RemoveFile(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.RemoveDir(remoteDir)
+}
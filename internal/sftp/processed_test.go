@@ -0,0 +1,21 @@
+package sftp
+
+import "testing"
+
+func TestProcessedPath(t *testing.T) {
+
+	tests := []struct {
+		remoteDir  string
+		remoteFile string
+		expected   string
+	}{
+		{"./Pickup", "Pickup/GA/file.csv", "GA/file.csv"},
+		{"Pickup", "Pickup/file.csv", "file.csv"},
+		{"./Pickup", "Other/file.csv", "file.csv"},
+	}
+	for _, tt := range tests {
+		if path := processedPath(tt.remoteDir, tt.remoteFile); path != tt.expected {
+			t.Errorf("Expected %s to be moved to %s, got %s", tt.remoteFile, tt.expected, path)
+		}
+	}
+}
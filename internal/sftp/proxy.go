@@ -0,0 +1,198 @@
+package sftp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// supported proxies
+const (
+	proxySOCKS5 = "socks5"
+	proxyHTTP   = "http"
+)
+
+// proxyTimeout limits connecting to the proxy and asking it for the tunnel
+const proxyTimeout = 30 * time.Second
+
+//ProxyConfig is the outbound proxy the connection to the SFTP server is made through.
+//When there are jump hosts the proxy is used to reach the first one
+type ProxyConfig struct {
+	// Type is socks5 or http for a proxy supporting CONNECT
+	Type     string `json:"type"`
+	Address  string `json:"address"`
+	UserName string `json:"username"`
+	Password string `json:"password"`
+}
+
+// dial opens a TCP connection to the address, through the proxy if there is one
+func (p *ProxyConfig) dial(address string) (net.Conn, error) {
+	if p == nil || p.Address == "" {
+		return net.Dial("tcp", address)
+	}
+
+	var handshake func(net.Conn, string) (net.Conn, error)
+	switch p.Type {
+	case proxySOCKS5:
+		handshake = p.socks5Connect
+	case proxyHTTP:
+		handshake = p.httpConnect
+	default:
+		return nil, fmt.Errorf("Unknown proxy type %s, expected %s or %s", p.Type, proxySOCKS5, proxyHTTP)
+	}
+
+	conn, err := net.DialTimeout("tcp", p.Address, proxyTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to the proxy %s: %s", p.Address, err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+
+	tunnel, err := handshake(conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s is unable to connect to %s: %s", p.Address, address, err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// socks5Connect asks the SOCKS5 proxy to connect to the address, see RFC 1928 and RFC 1929
+func (p *ProxyConfig) socks5Connect(conn net.Conn, address string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	// offer username and password authentication only when we have them
+	method := byte(0x00)
+	if p.UserName != "" {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return nil, fmt.Errorf("SOCKS5 authentication method was not accepted")
+	}
+
+	if method == 0x02 {
+		if len(p.UserName) > 255 || len(p.Password) > 255 {
+			return nil, fmt.Errorf("SOCKS5 username and password are limited to 255 bytes")
+		}
+		auth := []byte{0x01, byte(len(p.UserName))}
+		auth = append(auth, p.UserName...)
+		auth = append(auth, byte(len(p.Password)))
+		auth = append(auth, p.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0x00 {
+			return nil, fmt.Errorf("SOCKS5 username or password was refused")
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name %s is too long for SOCKS5", host)
+		}
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, 0x01)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	// version, reply, reserved, address type
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[1] != 0x00 {
+		return nil, fmt.Errorf("SOCKS5 connect failed with reply %d", header[1])
+	}
+
+	// skip the bound address and port
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		skip = int(length[0])
+	default:
+		return nil, fmt.Errorf("SOCKS5 reply has an unknown address type %d", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpConnect asks the HTTP proxy to open a tunnel to the address
+func (p *ProxyConfig) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if p.UserName != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.UserName + ":" + p.Password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	request += "\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT failed: %s", resp.Status)
+	}
+
+	// the server may have sent it's banner already, it's waiting in the reader
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what was buffered while reading the proxy response first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
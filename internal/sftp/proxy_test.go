@@ -0,0 +1,148 @@
+package sftp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+const banner = "SSH-2.0-pipefire\r\n"
+
+// startTarget accepts connections and sends a banner straight away like an SSH server
+func startTarget(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, banner)
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// startProxy runs handshake on each connection and then joins it to the requested address
+func startProxy(t *testing.T, handshake func(net.Conn) (string, error)) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				address, err := handshake(conn)
+				if err != nil {
+					return
+				}
+				target, err := net.Dial("tcp", address)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func socks5Handshake(conn net.Conn) (string, error) {
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{0x05, 0x02})
+
+	// username and password
+	version := make([]byte, 2)
+	io.ReadFull(conn, version)
+	user := make([]byte, version[1])
+	io.ReadFull(conn, user)
+	length := make([]byte, 1)
+	io.ReadFull(conn, length)
+	password := make([]byte, length[0])
+	io.ReadFull(conn, password)
+	if string(user) != "pipefire" || string(password) != "secret" {
+		conn.Write([]byte{0x01, 0x01})
+		return "", io.EOF
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	// connect to an IPv4 address
+	request := make([]byte, 10)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	ip := net.IP(request[4:8])
+	port := binary.BigEndian.Uint16(request[8:])
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+func httpHandshake(conn net.Conn) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+	// BasicAuth reads Authorization, the proxy header has the same format
+	req.Header.Set("Authorization", req.Header.Get("Proxy-Authorization"))
+	if user, password, ok := req.BasicAuth(); !ok || user != "pipefire" || password != "secret" {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", io.EOF
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, nil
+}
+
+func TestProxyDial(t *testing.T) {
+	target, stopTarget := startTarget(t)
+	defer stopTarget()
+
+	tests := []struct {
+		proxyType string
+		handshake func(net.Conn) (string, error)
+	}{
+		{proxySOCKS5, socks5Handshake},
+		{proxyHTTP, httpHandshake},
+	}
+	for _, tt := range tests {
+		address, stopProxy := startProxy(t, tt.handshake)
+		defer stopProxy()
+
+		proxy := &ProxyConfig{Type: tt.proxyType, Address: address, UserName: "pipefire", Password: "secret"}
+		conn, err := proxy.dial(target)
+		if err != nil {
+			t.Errorf("%s: %s", tt.proxyType, err.Error())
+			continue
+		}
+		received, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if received != banner {
+			t.Errorf("%s: expected the banner through the proxy, got %q", tt.proxyType, received)
+		}
+
+		proxy.Password = "wrong"
+		if _, err := proxy.dial(target); err == nil {
+			t.Errorf("%s: expected the wrong password to be refused", tt.proxyType)
+		}
+	}
+
+	if _, err := (&ProxyConfig{Type: "ftp", Address: "127.0.0.1:1"}).dial(target); err == nil {
+		t.Error("Expected an unknown proxy type to be refused")
+	}
+}
@@ -0,0 +1,61 @@
+package sftp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+//ResumeConfig defines if interrupted transfers carry on from where they stopped.
+//Not all servers support writing at an offset so this is off by default
+type ResumeConfig struct {
+	// Downloads continue from the size of the partial local file
+	Downloads bool `json:"downloads"`
+	// Uploads continue from the size of the partial remote file.
+	// Only temporary upload files are resumed so Upload needs to be configured
+	Uploads bool `json:"uploads"`
+}
+
+// downloadOffset is where to continue downloading the remote file from.
+// A partial local file which is older than the remote file is from a previous
+// version of the file and isn't resumed
+func (r *ResumeConfig) downloadOffset(local os.FileInfo, remote os.FileInfo) int64 {
+	if r == nil || !r.Downloads || local == nil || local.IsDir() {
+		return 0
+	}
+	if local.Size() == 0 || local.Size() >= remote.Size() {
+		return 0
+	}
+	if local.ModTime().Before(remote.ModTime()) {
+		return 0
+	}
+	return local.Size()
+}
+
+// uploadOffset is where to continue writing the partial remote file from
+func (r *ResumeConfig) uploadOffset(upload *UploadConfig, remote os.FileInfo, localSize int64) int64 {
+	if r == nil || !r.Uploads || !upload.atomic() || remote == nil || remote.IsDir() {
+		return 0
+	}
+	if remote.Size() == 0 || remote.Size() >= localSize {
+		return 0
+	}
+	return remote.Size()
+}
+
+// hashRemoteFile reads the whole remote file to provide it's hex encoded SHA256
+func (c transport) hashRemoteFile(remotePath string) (string, error) {
+	f, err := c.Client.Open(remotePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hashWriter := sha256.New()
+	if _, err := io.Copy(hashWriter, f); err != nil {
+		return "", fmt.Errorf("Unable to read back %s: %s", remotePath, err.Error())
+	}
+	return hex.EncodeToString(hashWriter.Sum(nil)), nil
+}
@@ -0,0 +1,93 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fileInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (f fileInfo) Name() string       { return "file.gpg" }
+func (f fileInfo) Size() int64        { return f.size }
+func (f fileInfo) Mode() os.FileMode  { return 0600 }
+func (f fileInfo) ModTime() time.Time { return f.modTime }
+func (f fileInfo) IsDir() bool        { return false }
+func (f fileInfo) Sys() interface{}   { return nil }
+
+func TestDownloadOffset(t *testing.T) {
+	now := time.Now()
+	remote := fileInfo{size: 100, modTime: now.Add(-time.Hour)}
+	resume := &ResumeConfig{Downloads: true}
+
+	var never *ResumeConfig
+	if offset := never.downloadOffset(fileInfo{size: 40, modTime: now}, remote); offset != 0 {
+		t.Errorf("Expected downloads to restart without a resume policy, got %d", offset)
+	}
+	if offset := resume.downloadOffset(fileInfo{size: 40, modTime: now}, remote); offset != 40 {
+		t.Errorf("Expected the download to resume from 40, got %d", offset)
+	}
+	if offset := resume.downloadOffset(nil, remote); offset != 0 {
+		t.Errorf("Expected the download to start from 0 without a partial file, got %d", offset)
+	}
+	if offset := resume.downloadOffset(fileInfo{size: 100, modTime: now}, remote); offset != 0 {
+		t.Errorf("Expected a complete local file to be downloaded again, got %d", offset)
+	}
+	if offset := resume.downloadOffset(fileInfo{size: 40, modTime: now.Add(-2 * time.Hour)}, remote); offset != 0 {
+		t.Errorf("Expected a partial file older than the remote file to be replaced, got %d", offset)
+	}
+}
+
+func TestUploadOffset(t *testing.T) {
+	partial := fileInfo{size: 40}
+	atomic := &UploadConfig{TempSuffix: ".part"}
+	resume := &ResumeConfig{Uploads: true}
+
+	if offset := resume.uploadOffset(atomic, partial, 100); offset != 40 {
+		t.Errorf("Expected the upload to resume from 40, got %d", offset)
+	}
+	if offset := resume.uploadOffset(nil, partial, 100); offset != 0 {
+		t.Errorf("Expected uploads directly to the final name not to resume, got %d", offset)
+	}
+	if offset := resume.uploadOffset(atomic, fileInfo{size: 100}, 100); offset != 0 {
+		t.Errorf("Expected a complete temporary file to be replaced, got %d", offset)
+	}
+	if offset := (&ResumeConfig{Downloads: true}).uploadOffset(atomic, partial, 100); offset != 0 {
+		t.Errorf("Expected uploads not to resume, got %d", offset)
+	}
+}
+
+func TestResumedDownloadIsChecked(t *testing.T) {
+	conn := newTestTransport(t, Endpoint{Resume: &ResumeConfig{Downloads: true}})
+	remoteDir := t.TempDir()
+	localDir := t.TempDir()
+	later := time.Now().Add(time.Hour)
+
+	writeFile(t, filepath.Join(remoteDir, "resumed.csv"), "0123456789")
+	writeFile(t, filepath.Join(localDir, "resumed.csv"), "01234")
+	os.Chtimes(filepath.Join(localDir, "resumed.csv"), later, later)
+
+	if _, err := conn.GetFile(filepath.Join(remoteDir, "resumed.csv"), localDir); err != nil {
+		t.Fatalf("Expected the download to resume: %s", err.Error())
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(localDir, "resumed.csv")); string(content) != "0123456789" {
+		t.Errorf("Unexpected content of the resumed download %s", content)
+	}
+
+	// the partial file isn't the start of the remote file
+	writeFile(t, filepath.Join(remoteDir, "stale.csv"), "0123456789")
+	writeFile(t, filepath.Join(localDir, "stale.csv"), "abcde")
+	os.Chtimes(filepath.Join(localDir, "stale.csv"), later, later)
+
+	if _, err := conn.GetFile(filepath.Join(remoteDir, "stale.csv"), localDir); err == nil {
+		t.Error("Expected the download of a different file to fail")
+	}
+	if exists(filepath.Join(localDir, "stale.csv")) {
+		t.Error("Expected the mismatched download to be removed")
+	}
+}
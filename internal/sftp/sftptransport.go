@@ -9,10 +9,11 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/user"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/masenocturnal/pipefire/internal/crypto"
 	"github.com/pkg/sftp"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
@@ -26,6 +27,35 @@ type Endpoint struct {
 	Password    string `json:"password"`
 	KeyPassword string `json:"keyPassword"`
 	Port        int64  `json:"port"`
+	// KnownHosts is an OpenSSH known_hosts file used to verify the server
+	KnownHosts string `json:"knownHosts"`
+	// HostKeyFingerprints are the SHA256 fingerprints of the server host keys i.e SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8
+	HostKeyFingerprints []string `json:"hostKeyFingerprints"`
+	// NextHostKeyFingerprints are accepted while the server is rotating it's host keys
+	NextHostKeyFingerprints []string `json:"nextHostKeyFingerprints"`
+	// Upload writes files to a temporary name first if set
+	Upload *UploadConfig `json:"upload"`
+	// Resume continues interrupted transfers if set
+	Resume *ResumeConfig `json:"resume"`
+	// Verify checks the hash of uploaded files if set
+	Verify *VerifyConfig `json:"verify"`
+	// Certificate is the OpenSSH user certificate for Key i.e ~/.ssh/id_rsa-cert.pub
+	Certificate string `json:"certificate"`
+	// Keys are tried in order after Key
+	Keys []PrivateKey `json:"keys"`
+	// Agent uses the keys held by the ssh-agent listening on SSH_AUTH_SOCK
+	Agent bool `json:"agent"`
+	// KeyboardInteractive answers the server's password prompt with Password
+	KeyboardInteractive bool `json:"keyboardInteractive"`
+	// JumpHosts are connected to in order and the connection to the endpoint is
+	// tunnelled through them, like OpenSSH ProxyJump
+	JumpHosts []Endpoint `json:"jumpHosts"`
+	// Proxy is the outbound SOCKS5 or HTTP proxy to connect through
+	Proxy *ProxyConfig `json:"proxy"`
+	// MaxSessions is the number of connections the server allows at the same time, 0 is unlimited
+	MaxSessions int `json:"maxSessions"`
+	// KeepAlive is the number of seconds between keepalive requests on pooled connections, the default is 30
+	KeepAlive int `json:"keepAlive"`
 }
 
 //FileTransferConfirmation is a summmary of the transferred file
@@ -39,13 +69,18 @@ type FileTransferConfirmation struct {
 	RemoteSize       int64
 	TransferredHash  string
 	TransferredBytes int64
+	// Verification is set when the upload was verified before it was renamed
+	Verification *Verification
 }
 
 type transport struct {
 	Client  *sftp.Client
 	Session *ssh.Client
 	Name    string
+	conf    Endpoint
 	log     *log.Entry
+	// jumps are the connections to the jump hosts the session is tunnelled through
+	jumps []*ssh.Client
 }
 
 // Transport is the accessible type for the sftp connection
@@ -56,6 +91,10 @@ type Transport interface {
 	GetFile(remoteFile string, localFile string) (*FileTransferConfirmation, error)
 	GetDir(remoteDir string, localDir string) (*list.List, *list.List)
 	CleanDir(string) error
+	RemoveFetched([]*FileTransferConfirmation) error
+	MoveFetched(confirmations []*FileTransferConfirmation, remoteDir string, processedDir string) error
+	PurgeProcessed(processedRoot string, before time.Time) ([]string, error)
+	VerifyFile(*FileTransferConfirmation) (*Verification, error)
 	RemoveDir(string) error
 	RemoveFile(string) error
 	Close()
@@ -63,41 +102,16 @@ type Transport interface {
 
 //NewConnection establish a connection
 func NewConnection(name string, conf Endpoint, log *log.Entry) (Transport, error) {
-	var transport transport
-
-	var authMethod []ssh.AuthMethod = make([]ssh.AuthMethod, 0)
-
-	if len(conf.Key) > 0 {
-
-		if strings.Index(conf.Key, "~") == 0 {
-			usr, err := user.Current()
-			if err != nil {
-				return nil, err
-			}
-
-			conf.Key = strings.Replace(conf.Key, "~", usr.HomeDir, 1)
-		}
-		keyAuth, err := getPrivateKeyAuthentication(conf.Key, conf.KeyPassword)
-		if err != nil {
-			return transport, err
-		}
-		authMethod = append(authMethod, keyAuth)
-
-	}
-	if len(conf.Password) > 0 {
-		authMethod = append(authMethod, ssh.Password(conf.Password))
+	transport, err := connect(name, conf, log)
+	if err != nil {
+		return nil, err
 	}
+	return transport, nil
+}
 
-	// attempt to connect
-	connDetails := &ssh.ClientConfig{
-		User:            conf.UserName,
-		Auth:            authMethod,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-
-		// max time to establish connection
-		//HostKeyCallback: ssh.FixedHostKey(hostKey),
-	}
-	connDetails.SetDefaults()
+// connect opens the SSH session and starts the SFTP subsystem
+func connect(name string, conf Endpoint, log *log.Entry) (transport, error) {
+	var transport transport
 
 	// @todo validate config
 	if conf.Host == "" {
@@ -108,29 +122,28 @@ func NewConnection(name string, conf Endpoint, log *log.Entry) (Transport, error
 		conf.Port = 22
 	}
 
-	connectionString := fmt.Sprintf("%s:%d", conf.Host, conf.Port)
-	log.Infof("Attempting to connect to %s ", connectionString)
+	connectionString := conf.address()
 
-	// connect
-	sshClient, err := ssh.Dial("tcp", connectionString, connDetails)
+	// connect, through the jump hosts if there are any
+	sshClient, jumps, err := dial(conf, log)
 	if err != nil {
-		return nil, err
+		return transport, err
 	}
 	transport.Session = sshClient
-
-	go func() {
-		log.Debug("Connection Closed")
-	}()
+	transport.jumps = jumps
 
 	opts := sftp.MaxConcurrentRequestsPerFile(1)
 
 	// create new SFTP client
 	transport.Client, err = sftp.NewClient(transport.Session, opts)
 	if err != nil {
-		return nil, err
+		sshClient.Close()
+		closeClients(jumps)
+		return transport, err
 	}
 	log.Printf("Connnected to %s ", connectionString)
 	transport.Name = name
+	transport.conf = conf
 	transport.log = log
 
 	return transport, err
@@ -175,6 +188,50 @@ func (c transport) CleanDir(remoteDir string) error {
 	return lastError
 }
 
+//RemoveFetched removes the remote files which were collected by GetFile or GetDir.
+//Files are only removed if the remote size hasn't changed and the local copy still
+//matches the hash taken when it was collected. Anything else in the directory is left alone
+func (c transport) RemoveFetched(confirmations []*FileTransferConfirmation) error {
+	var lastError error
+	for _, xfer := range confirmations {
+		if xfer == nil || xfer.RemoteFileName == "" || xfer.LocalHash == "" {
+			continue
+		}
+		if err := c.removeFetchedFile(xfer); err != nil {
+			c.log.Warnf("Not removing %s: %s", xfer.RemoteFileName, err.Error())
+			lastError = err
+		}
+	}
+	return lastError
+}
+
+func (c transport) removeFetchedFile(xfer *FileTransferConfirmation) error {
+	if err := c.verifyFetched(xfer); err != nil {
+		return err
+	}
+	return c.RemoveFile(xfer.RemoteFileName)
+}
+
+// verifyFetched ensures the remote file is still the one that was collected
+func (c transport) verifyFetched(xfer *FileTransferConfirmation) error {
+	remoteFile, err := c.Client.Lstat(xfer.RemoteFileName)
+	if err != nil {
+		return err
+	}
+	if remoteFile.Size() != xfer.RemoteSize {
+		return fmt.Errorf("Remote size is %d but %d bytes were collected, the file has changed", remoteFile.Size(), xfer.RemoteSize)
+	}
+
+	localHash, err := crypto.HashFile(xfer.LocalFileName)
+	if err != nil {
+		return err
+	}
+	if localHash != xfer.LocalHash {
+		return fmt.Errorf("Local copy %s no longer matches the hash %s", xfer.LocalFileName, xfer.LocalHash)
+	}
+	return nil
+}
+
 //RemoveDir wrapper arround the underlying SFTP Client RemoveDir function
 func (c transport) RemoveDir(remoteDir string) error {
 	err := c.Client.RemoveDirectory(remoteDir)
@@ -232,15 +289,42 @@ func (c transport) GetFile(remotePath string, localPath string) (*FileTransferCo
 		localPath = filepath.Join(localPath, remoteFile.Name())
 	}
 
+	// carry on from a previous attempt if the endpoint allows it
+	partial, _ := os.Stat(localPath)
+	offset := c.conf.Resume.downloadOffset(partial, remoteFile)
+
 	// All good, now download it
-	dstFile, err := os.Create(localPath)
-	if err != nil {
-		return xfer, err
+	var dstFile *os.File
+	if offset > 0 {
+		c.log.Infof("Resuming download of %s from %d bytes", remotePath, offset)
+		dstFile, err = os.OpenFile(localPath, os.O_RDWR, 0)
+		if err != nil {
+			return xfer, err
+		}
+		// the hash covers the whole file, reading the partial file leaves it positioned at the offset
+		if _, err := io.CopyN(hashWriter, dstFile, offset); err != nil {
+			dstFile.Close()
+			return xfer, err
+		}
+	} else {
+		dstFile, err = os.Create(localPath)
+		if err != nil {
+			return xfer, err
+		}
 	}
 	defer dstFile.Close()
 
 	// open source file
 	sourceReader, err := c.Client.Open(remotePath)
+	if err != nil {
+		return xfer, err
+	}
+	defer sourceReader.Close()
+	if offset > 0 {
+		if _, err := sourceReader.Seek(offset, io.SeekStart); err != nil {
+			return xfer, err
+		}
+	}
 	multiWriter := io.MultiWriter(dstFile, hashWriter)
 
 	// copy source file to destination file
@@ -265,12 +349,26 @@ func (c transport) GetFile(remotePath string, localPath string) (*FileTransferCo
 	xfer.LocalSize = localFileInfo.Size()
 
 	// read it back to hash the file
-	contents, _ := ioutil.ReadFile(localPath)
+	xfer.LocalHash, err = crypto.HashFile(localPath)
+	if err != nil {
+		return xfer, err
+	}
 
-	// we've used the hashWriter prevously so it needs to be reset
-	hashWriter.Reset()
-	hashWriter.Write(contents)
-	xfer.LocalHash = hex.EncodeToString(hashWriter.Sum(nil))
+	if offset > 0 {
+		// the partial file may not be the start of the remote file so read all of the
+		// remote file back, a file which doesn't match is removed to start again next time
+		remoteHash, err := c.hashRemoteFile(remotePath)
+		if err != nil {
+			return xfer, err
+		}
+		if xfer.LocalSize != xfer.RemoteSize || xfer.LocalHash != remoteHash {
+			dstFile.Close()
+			if rmErr := os.Remove(localPath); rmErr != nil {
+				c.log.Warnf("Unable to remove resumed download %s: %s", localPath, rmErr.Error())
+			}
+			return xfer, fmt.Errorf("Resumed download of %s is %d bytes with hash %s, expected %d bytes with hash %s", remotePath, xfer.LocalSize, xfer.LocalHash, xfer.RemoteSize, remoteHash)
+		}
+	}
 
 	c.log.Debugln("Transferred")
 	return xfer, err
@@ -381,23 +479,17 @@ func (c transport) SendFile(localPath string, remotePath string) (*FileTransferC
 	xfer.LocalPath = localPath
 
 	// ensure we can read the local file first before we create the remote file
-	data, err := ioutil.ReadFile(localPath)
-
-	// calculate local checksum
-	_, err = hashWriter.Write(data)
+	localFile, err := os.Open(localPath)
 	if err != nil {
 		return xfer, err
 	}
-	xfer.LocalHash = hex.EncodeToString(hashWriter.Sum(nil))
+	defer localFile.Close()
 
-	// reset the hashWriter so that we can use the same writer for the remote file
-	hashWriter.Reset()
+	// the local checksum is calculated as the file is read
+	localHashWriter := sha256.New()
 
 	// get the SFTP Client connectied to the destination server
 	client := c.Client
-	if err != nil {
-		return xfer, err
-	}
 
 	// see if the remote file exists..
 	p, err := client.Stat(remotePath)
@@ -429,28 +521,61 @@ func (c transport) SendFile(localPath string, remotePath string) (*FileTransferC
 		}
 	}
 
-	c.log.Debugf("Trying to create %s", remotePath)
+	// write to a temporary file first if the endpoint requires it
+	uploadPath := c.conf.Upload.tempPath(remotePath)
+
+	// carry on from a previous attempt if the endpoint allows it
+	var offset int64
+	if partial, err := client.Stat(uploadPath); err == nil {
+		offset = c.conf.Resume.uploadOffset(c.conf.Upload, partial, xfer.LocalSize)
+	}
+
+	c.log.Debugf("Trying to create %s", uploadPath)
 	// Create the remote file for writing
 	//remoteFile, err := client.Create(remotePath)
-	remoteFile, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	}
+	remoteFile, err := client.OpenFile(uploadPath, flags)
 	if err != nil {
-		c.log.Errorf("Unable to create file %s , %s", remotePath, err.Error())
+		c.log.Errorf("Unable to create file %s , %s", uploadPath, err.Error())
 		// do we close the connection here ?
 		return xfer, err
 	}
 
-	xfer.RemoteFileName = remoteFile.Name()
+	if offset > 0 {
+		c.log.Infof("Resuming upload of %s from %d bytes", uploadPath, offset)
+		if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+			remoteFile.Close()
+			return xfer, err
+		}
+		// the part which has already been sent still needs to be in the local checksum
+		if _, err := io.CopyN(localHashWriter, localFile, offset); err != nil {
+			remoteFile.Close()
+			return xfer, err
+		}
+	}
+
+	xfer.RemoteFileName = remotePath
 	xfer.RemotePath = remotePath
 
 	// write the bytes to the remote file _and_ the hash writer at the same time
-	// @todo use TeeReader ?
 	multiwriter := io.MultiWriter(remoteFile, hashWriter)
 
 	// actually write the packets
-	transferredBytes, err := multiwriter.Write(data)
+	transferredBytes, copyErr := io.Copy(multiwriter, io.TeeReader(localFile, localHashWriter))
+	if copyErr != nil {
+		// finish the local checksum so that it's the hash of the whole file
+		io.Copy(localHashWriter, localFile)
+	}
+	xfer.LocalHash = hex.EncodeToString(localHashWriter.Sum(nil))
 
 	// close the connection
 	err = remoteFile.Close()
+	if err == nil {
+		err = copyErr
+	}
 	if err != nil {
 		c.log.Debug("File successfully closed on the remote end", remotePath, err.Error())
 		c.log.Errorf("Error writing %s. Error: %s", remotePath, err.Error())
@@ -458,21 +583,50 @@ func (c transport) SendFile(localPath string, remotePath string) (*FileTransferC
 	} else {
 		xfer.TransferredBytes = int64(transferredBytes)
 		xfer.TransferredHash = hex.EncodeToString(hashWriter.Sum(nil))
-		xfer.RemoteSize = xfer.TransferredBytes
+		xfer.RemoteSize = offset + xfer.TransferredBytes
+	}
+
+	if err == nil && offset > 0 {
+		// only part of the file was written this time so check all of it
+		xfer.TransferredHash, err = c.hashRemoteFile(uploadPath)
+	}
+
+	if c.conf.Upload.atomic() {
+		if err != nil {
+			// leave the temporary file for the next attempt to replace
+			return xfer, err
+		}
+
+		// the temporary file is ours so it has to be there
+		remoteFileInfo, err := client.Stat(uploadPath)
+		if err != nil {
+			return xfer, fmt.Errorf("Unable to stat %s after transfer: %s", uploadPath, err.Error())
+		}
+		xfer.RemoteSize = remoteFileInfo.Size()
+
+		if err := c.commitUpload(uploadPath, remotePath, xfer); err != nil {
+			return xfer, err
+		}
+		c.log.Debug("Transferred")
+		return xfer, nil
+	}
+
+	if err != nil {
+		return xfer, err
 	}
 
 	// sometimes SFTP Servers will lock or whisk away the file after the
 	// file handle has closed
 	// I think some sftp servers have issues with this
-	remoteFileInfo, err := client.Stat(remotePath)
-	if err != nil {
-		c.log.Warnf("Error getting size of remote file after transfer, file may have been locked or moved ")
+	remoteFileInfo, statErr := client.Stat(remotePath)
+	if statErr != nil {
+		c.log.Warnf("Error getting size of remote file after transfer, file may have been locked or moved: %s", statErr.Error())
 	} else {
 		xfer.RemoteSize = remoteFileInfo.Size()
 	}
 
 	c.log.Debug("Transferred")
-	return xfer, err
+	return xfer, nil
 }
 
 //ListRemoteDir Lists the files in a remote directory
@@ -578,18 +732,9 @@ func (c transport) SendDir(srcDir string, destDir string) (confirmationList *lis
 	return
 }
 
-func (c transport) handleReconnects() {
-	closed := make(chan error, 1)
-	go func() {
-		closed <- c.Session.Wait()
-	}()
-	c.log.Printf("Here %v ", closed)
-	c.log.Println("IN HERE")
-}
-
 //Close closes
 func (c transport) Close() {
 	c.Client.Close()
 	c.Session.Close()
-
+	closeClients(c.jumps)
 }
@@ -0,0 +1,137 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+)
+
+// newTestTransport connects to an SFTP server running in the test against the local file system
+func newTestTransport(t *testing.T, conf Endpoint) transport {
+	clientConn, serverConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return transport{Client: client, Name: "test", conf: conf, log: log.WithField("test", "sftp")}
+}
+
+// failingWriter is a remote file which can't be written to
+type failingWriter struct{}
+
+func (failingWriter) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("No space left on device")
+}
+
+// failingPut creates the file but fails to write to it
+type failingPut struct {
+	sftp.FileWriter
+}
+
+func (f failingPut) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if _, err := f.FileWriter.Filewrite(r); err != nil {
+		return nil, err
+	}
+	return failingWriter{}, nil
+}
+
+// newFailingTransport connects to an in memory SFTP server which can't write files
+func newFailingTransport(t *testing.T, conf Endpoint) transport {
+	handlers := sftp.InMemHandler()
+	handlers.FilePut = failingPut{handlers.FilePut}
+
+	clientConn, serverConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, handlers)
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return transport{Client: client, Name: "test", conf: conf, log: log.WithField("test", "sftp")}
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRemoveFetchedLeavesChangedFiles(t *testing.T) {
+	conn := newTestTransport(t, Endpoint{})
+	remoteDir := t.TempDir()
+	localDir := t.TempDir()
+
+	writeFile(t, filepath.Join(remoteDir, "collected.csv"), "collected")
+	writeFile(t, filepath.Join(remoteDir, "changed.csv"), "changed")
+	writeFile(t, filepath.Join(remoteDir, "edited.csv"), "edited")
+
+	confirmations, errs := conn.GetDir(remoteDir, localDir)
+	if errs.Len() > 0 {
+		t.Fatal(errs.Front().Value)
+	}
+	var fetched []*FileTransferConfirmation
+	for c := confirmations.Front(); c != nil; c = c.Next() {
+		fetched = append(fetched, c.Value.(*FileTransferConfirmation))
+	}
+
+	// more was written to the remote file after it was collected
+	writeFile(t, filepath.Join(remoteDir, "changed.csv"), "changed again")
+	// the local copy no longer matches what was collected
+	writeFile(t, filepath.Join(localDir, "edited.csv"), "edited!")
+	// arrived after the collection
+	writeFile(t, filepath.Join(remoteDir, "late.csv"), "late")
+
+	if err := conn.RemoveFetched(fetched); err == nil {
+		t.Error("Expected an error for the files which changed")
+	}
+
+	if exists(filepath.Join(remoteDir, "collected.csv")) {
+		t.Error("Expected the collected file to be removed")
+	}
+	for _, name := range []string{"changed.csv", "edited.csv", "late.csv"} {
+		if !exists(filepath.Join(remoteDir, name)) {
+			t.Errorf("Expected %s to be left in place", name)
+		}
+	}
+}
+
+func TestSendFileReportsFailedWrites(t *testing.T) {
+	conn := newFailingTransport(t, Endpoint{})
+	if err := conn.Client.Mkdir("/out"); err != nil {
+		t.Fatal(err)
+	}
+	localPath := filepath.Join(t.TempDir(), "file.gpg")
+	writeFile(t, localPath, "0123456789")
+
+	// the file is written directly to it's name so the failure has to be returned
+	if _, err := conn.SendFile(localPath, "/out"); err == nil {
+		t.Error("Expected the failed write to be returned")
+	}
+}
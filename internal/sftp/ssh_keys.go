@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/user"
+	"strings"
 
 	"github.com/ScaleFT/sshkeys"
 	"golang.org/x/crypto/ssh"
 )
 
-func getPrivateKeyAuthentication(keyPath string, keyPassword string) (ssh.AuthMethod, error) {
+func getPrivateKeySigner(keyPath string, keyPassword string) (ssh.Signer, error) {
 
 	if !keyExists(keyPath) {
 		return nil, fmt.Errorf("File: %s doesn't exist ", keyPath)
@@ -31,7 +33,40 @@ func getPrivateKeyAuthentication(keyPath string, keyPassword string) (ssh.AuthMe
 		e := fmt.Errorf("Unable to decrypt private key. You may need to supply a decryption password %s", err.Error())
 		return nil, e
 	}
-	return ssh.PublicKeys(signer), err
+	return signer, err
+}
+
+// getCertificateSigner presents the OpenSSH certificate for the key i.e id_rsa-cert.pub
+func getCertificateSigner(certPath string, signer ssh.Signer) (ssh.Signer, error) {
+	certInBytes, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certInBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the certificate %s: %s", certPath, err.Error())
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an OpenSSH certificate", certPath)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s is not a user certificate", certPath)
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// expandHome replaces a leading ~ with the home directory of the current user
+func expandHome(path string) (string, error) {
+	if strings.Index(path, "~") != 0 {
+		return path, nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(path, "~", usr.HomeDir, 1), nil
 }
 
 func keyExists(filename string) bool {
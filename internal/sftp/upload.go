@@ -0,0 +1,96 @@
+package sftp
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const posixRenameExtension = "posix-rename@openssh.com"
+
+//UploadConfig defines how files are uploaded so that the recipient never sees a partial file.
+//Files are written to a temporary name and renamed once the size of the temporary file has been checked
+type UploadConfig struct {
+	// TempPrefix and TempSuffix are added to the file name while it's being written i.e .part
+	TempPrefix string `json:"tempPrefix"`
+	TempSuffix string `json:"tempSuffix"`
+	// TempDir is a remote directory to write the file to before it's moved to the destination.
+	// It needs to be on the same file system as the destination
+	TempDir string `json:"tempDir"`
+}
+
+// atomic determines if uploads are written to a temporary file first
+func (u *UploadConfig) atomic() bool {
+	return u != nil && (u.TempPrefix != "" || u.TempSuffix != "" || u.TempDir != "")
+}
+
+// tempPath is where the file is written before it's renamed to remotePath
+func (u *UploadConfig) tempPath(remotePath string) string {
+	if !u.atomic() {
+		return remotePath
+	}
+
+	dir, name := filepath.Split(remotePath)
+	if u.TempDir != "" {
+		dir = u.TempDir
+	}
+	return filepath.Join(dir, u.TempPrefix+name+u.TempSuffix)
+}
+
+// commitUpload moves the temporary file to it's final name once checkWritten passes and
+// the temporary file has been verified. The temporary file is removed if either fails
+// so that the recipient never sees a file which doesn't match
+func (c transport) commitUpload(tempPath string, remotePath string, xfer *FileTransferConfirmation) error {
+	if tempPath == remotePath {
+		return nil
+	}
+
+	if err := checkWritten(xfer); err != nil {
+		c.log.Errorf("Upload of %s is incomplete, removing %s: %s", xfer.LocalPath, tempPath, err.Error())
+		if e := c.Client.Remove(tempPath); e != nil {
+			c.log.Warnf("Unable to remove %s: %s", tempPath, e.Error())
+		}
+		return err
+	}
+
+	if c.conf.Verify != nil {
+		verification, err := c.verifyPath(tempPath, xfer)
+		xfer.Verification = verification
+		if err != nil {
+			c.log.Errorf("Upload of %s failed verification, removing %s: %s", xfer.LocalPath, tempPath, err.Error())
+			if e := c.Client.Remove(tempPath); e != nil {
+				c.log.Warnf("Unable to remove %s: %s", tempPath, e.Error())
+			}
+			return err
+		}
+	}
+
+	if err := c.rename(tempPath, remotePath); err != nil {
+		return fmt.Errorf("Unable to rename %s to %s, %s has been left in place: %s", tempPath, remotePath, tempPath, err.Error())
+	}
+	return nil
+}
+
+// rename uses posix-rename when the server supports it so that an existing file is replaced
+func (c transport) rename(oldPath string, newPath string) error {
+	if _, ok := c.Client.HasExtension(posixRenameExtension); ok {
+		c.log.Debugf("Renaming %s to %s using %s", oldPath, newPath, posixRenameExtension)
+		return c.Client.PosixRename(oldPath, newPath)
+	}
+
+	c.log.Debugf("Renaming %s to %s", oldPath, newPath)
+	return c.Client.Rename(oldPath, newPath)
+}
+
+// checkWritten compares the size of the remote file with the local file.
+// TransferredHash is the hash of the stream which was written so it only differs from the
+// local hash when the upload was resumed, where it's read back from the server. It doesn't
+// prove what the server stored, VerifyConfig is used for that
+func checkWritten(xfer *FileTransferConfirmation) error {
+	if xfer.RemoteSize != xfer.LocalSize {
+		return fmt.Errorf("Remote size %d does not match the local size %d", xfer.RemoteSize, xfer.LocalSize)
+	}
+	if xfer.TransferredHash != xfer.LocalHash {
+		return fmt.Errorf("Transferred hash %s does not match the local hash %s", xfer.TransferredHash, xfer.LocalHash)
+	}
+	return nil
+}
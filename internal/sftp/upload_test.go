@@ -0,0 +1,93 @@
+package sftp
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadTempPath(t *testing.T) {
+
+	var direct *UploadConfig
+	if path := direct.tempPath("Out/Certegy/DE/file.gpg"); path != "Out/Certegy/DE/file.gpg" {
+		t.Errorf("Expected files to be written directly without upload config, got %s", path)
+	}
+
+	tests := []struct {
+		conf     UploadConfig
+		expected string
+	}{
+		{UploadConfig{TempSuffix: ".part"}, "Out/Certegy/DE/file.gpg.part"},
+		{UploadConfig{TempPrefix: "."}, "Out/Certegy/DE/.file.gpg"},
+		{UploadConfig{TempDir: "Out/tmp", TempSuffix: ".part"}, "Out/tmp/file.gpg.part"},
+	}
+	for _, tt := range tests {
+		if path := tt.conf.tempPath("Out/Certegy/DE/file.gpg"); path != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, path)
+		}
+	}
+}
+
+func TestCheckWritten(t *testing.T) {
+
+	xfer := &FileTransferConfirmation{
+		LocalSize:       42,
+		RemoteSize:      42,
+		LocalHash:       "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		TransferredHash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}
+	if err := checkWritten(xfer); err != nil {
+		t.Errorf("Expected the upload to pass: %s", err.Error())
+	}
+
+	xfer.RemoteSize = 41
+	if err := checkWritten(xfer); err == nil {
+		t.Error("Expected a short upload to fail")
+	}
+
+	xfer.RemoteSize = 42
+	// a resumed upload read back from the server
+	xfer.TransferredHash = "00"
+	if err := checkWritten(xfer); err == nil {
+		t.Error("Expected a hash mismatch to fail")
+	}
+}
+
+func TestCommitUploadVerifiesTempFile(t *testing.T) {
+	conn := newTestTransport(t, Endpoint{
+		Upload: &UploadConfig{TempSuffix: ".part"},
+		Verify: &VerifyConfig{ReadBack: true},
+	})
+	localDir := t.TempDir()
+	remoteDir := t.TempDir()
+	writeFile(t, filepath.Join(localDir, "file.gpg"), "0123456789")
+
+	xfer, err := conn.SendFile(filepath.Join(localDir, "file.gpg"), remoteDir)
+	if err != nil {
+		t.Fatalf("Expected the upload to pass: %s", err.Error())
+	}
+	if xfer.Verification == nil || !xfer.Verification.Verified || xfer.Verification.Method != verifyReadBack {
+		t.Errorf("Expected the temporary file to be read back %+v", xfer.Verification)
+	}
+	if !exists(filepath.Join(remoteDir, "file.gpg")) || exists(filepath.Join(remoteDir, "file.gpg.part")) {
+		t.Error("Expected the verified upload to be renamed")
+	}
+
+	// the server stored something other than what was written
+	tempPath := filepath.Join(remoteDir, "other.gpg.part")
+	writeFile(t, tempPath, "9876543210")
+	xfer = &FileTransferConfirmation{
+		LocalSize:       10,
+		RemoteSize:      10,
+		LocalHash:       xfer.LocalHash,
+		TransferredHash: xfer.LocalHash,
+	}
+	if err := conn.commitUpload(tempPath, filepath.Join(remoteDir, "other.gpg"), xfer); err == nil {
+		t.Error("Expected the mismatched upload to fail")
+	}
+	if xfer.Verification == nil || xfer.Verification.Verified {
+		t.Errorf("Expected the verification to fail %+v", xfer.Verification)
+	}
+	if exists(tempPath) || exists(filepath.Join(remoteDir, "other.gpg")) {
+		t.Error("Expected the mismatched upload to be removed and not renamed")
+	}
+}
@@ -0,0 +1,109 @@
+package sftp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// methods used to verify an upload
+const (
+	verifySize     = "size"
+	verifyReadBack = "readBack"
+	verifyChecksum = "checksum"
+)
+
+//VerifyConfig defines how uploads are checked once they are on the remote server.
+//The size of the remote file is always checked. Uploads written to a temporary file are
+//verified before they're renamed. Servers which move files away as soon as they arrive
+//can't be verified
+type VerifyConfig struct {
+	// ReadBack downloads the file again to compare the hash
+	ReadBack bool `json:"readBack"`
+	// ChecksumCommand is run on the server to hash the file i.e "sha256sum %s".
+	// The first word of the output is compared with the SHA256 of the local file
+	ChecksumCommand string `json:"checksumCommand"`
+}
+
+//Verification is the outcome of checking an uploaded file
+type Verification struct {
+	Method     string
+	RemoteSize int64
+	RemoteHash string
+	Verified   bool
+}
+
+//VerifyFile checks the uploaded file matches the local file.
+//An error is returned if the file doesn't match or can't be checked
+func (c transport) VerifyFile(xfer *FileTransferConfirmation) (*Verification, error) {
+	return c.verifyPath(xfer.RemotePath, xfer)
+}
+
+// verifyPath checks the remote file at path matches the local file of the transfer,
+// which is the temporary file when the upload hasn't been renamed yet
+func (c transport) verifyPath(remotePath string, xfer *FileTransferConfirmation) (*Verification, error) {
+	verification := &Verification{Method: verifySize}
+
+	remoteFile, err := c.Client.Stat(remotePath)
+	if err != nil {
+		return verification, fmt.Errorf("Unable to stat %s to verify it: %s", remotePath, err.Error())
+	}
+	verification.RemoteSize = remoteFile.Size()
+	if verification.RemoteSize != xfer.LocalSize {
+		return verification, fmt.Errorf("Remote file %s is %d bytes, expected %d", remotePath, verification.RemoteSize, xfer.LocalSize)
+	}
+
+	conf := c.conf.Verify
+	switch {
+	case conf == nil:
+		verification.Verified = true
+		return verification, nil
+	case conf.ReadBack:
+		verification.Method = verifyReadBack
+		verification.RemoteHash, err = c.hashRemoteFile(remotePath)
+	case conf.ChecksumCommand != "":
+		verification.Method = verifyChecksum
+		verification.RemoteHash, err = c.remoteChecksum(conf.ChecksumCommand, remotePath)
+	default:
+		verification.Verified = true
+		return verification, nil
+	}
+	if err != nil {
+		return verification, err
+	}
+
+	if !strings.EqualFold(verification.RemoteHash, xfer.LocalHash) {
+		return verification, fmt.Errorf("Remote file %s has hash %s, expected %s", remotePath, verification.RemoteHash, xfer.LocalHash)
+	}
+	c.log.Debugf("Verified %s using %s", remotePath, verification.Method)
+	verification.Verified = true
+	return verification, nil
+}
+
+// remoteChecksum runs the checksum command for the file on the server
+func (c transport) remoteChecksum(command string, remotePath string) (string, error) {
+	session, err := c.Session.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("Unable to open a session to run %s: %s", command, err.Error())
+	}
+	defer session.Close()
+
+	out, err := session.Output(checksumCommand(command, remotePath))
+	if err != nil {
+		return "", fmt.Errorf("Unable to run %s on %s: %s", command, remotePath, err.Error())
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s didn't return a checksum for %s", command, remotePath)
+	}
+	return fields[0], nil
+}
+
+// checksumCommand adds the quoted path to the command
+func checksumCommand(command string, remotePath string) string {
+	quoted := "'" + strings.ReplaceAll(remotePath, "'", `'\''`) + "'"
+	if strings.Contains(command, "%s") {
+		return fmt.Sprintf(command, quoted)
+	}
+	return command + " " + quoted
+}
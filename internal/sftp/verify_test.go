@@ -0,0 +1,22 @@
+package sftp
+
+import "testing"
+
+func TestChecksumCommand(t *testing.T) {
+
+	tests := []struct {
+		command  string
+		path     string
+		expected string
+	}{
+		{"sha256sum %s", "Out/Certegy/DE/file.gpg", "sha256sum 'Out/Certegy/DE/file.gpg'"},
+		{"sha256sum", "Out/file.gpg", "sha256sum 'Out/file.gpg'"},
+		{"sha256sum %s", "Out/it's.gpg", `sha256sum 'Out/it'\''s.gpg'`},
+		{"sha256sum %s", "Out/$(reboot).gpg", "sha256sum 'Out/$(reboot).gpg'"},
+	}
+	for _, tt := range tests {
+		if cmd := checksumCommand(tt.command, tt.path); cmd != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, cmd)
+		}
+	}
+}
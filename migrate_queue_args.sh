@@ -0,0 +1,42 @@
+#!/bin/bash
+
+# RabbitMQ refuses to declare a queue which already exists with different arguments.
+# Queues created before the arguments were added to config/directdebit.json need to be
+# deleted and declared again with the new arguments before pipefire will start.
+#
+# Stop pipefired first. The queue is only deleted if it's empty so that no messages are
+# lost, it's declared and bound again straight away so messages published while
+# pipefired is stopped are kept.
+
+set -e
+
+vhost=""
+queue="BankFileTransfer.Incoming"
+exchange="BankFileTransfer.Incoming"
+arguments='{"x-dead-letter-exchange": "BankFileTransfer.Incoming_error"}'
+
+errorQueue="BankFileTransfer.Incoming_error"
+errorExchange="BankFileTransfer.Incoming_error"
+errorArguments='{"x-queue-type": "classic"}'
+
+migrate() {
+  local queue=$1 exchange=$2 arguments=$3
+
+  messages=`rabbitmqadmin -V "$vhost" -f tsv -q list queues name messages | awk -v q="$queue" '$1 == q { print $2 }'`
+  if [ -z "$messages" ]; then
+    echo "$queue doesn't exist, pipefire will declare it"
+    return
+  fi
+  if [ "$messages" != "0" ]; then
+    echo "$queue has $messages messages, it needs to be empty before it's migrated"
+    exit 1
+  fi
+
+  rabbitmqadmin -V "$vhost" delete queue name="$queue"
+  rabbitmqadmin -V "$vhost" declare queue name="$queue" durable=true arguments="$arguments"
+  rabbitmqadmin -V "$vhost" declare binding source="$exchange" destination="$queue" routing_key=""
+  echo "$queue has been declared with $arguments"
+}
+
+migrate "$errorQueue" "$errorExchange" "$errorArguments"
+migrate "$queue" "$exchange" "$arguments"
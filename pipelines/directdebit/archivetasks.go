@@ -3,6 +3,7 @@ package directdebit
 import (
 	"archive/tar"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -71,6 +72,18 @@ func getFileList(src string) ([]string, error) {
 	return fileList, err
 }
 
+// copyFile streams the contents of the file to w
+func copyFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
 func (d ddPipeline) createTar(filePaths []string, destDir string) (errors []error) {
 
 	if err := os.MkdirAll(destDir, 0760); err != nil {
@@ -105,15 +118,10 @@ func (d ddPipeline) createTar(filePaths []string, destDir string) (errors []erro
 		if err := tw.WriteHeader(hdr); err != nil {
 			log.Fatal(err)
 		}
-		contents, err := ioutil.ReadFile(file)
-		if err != nil {
+		if err := copyFile(tw, file); err != nil {
 			d.log.Errorf("Error reading file: %s : %s", file, err.Error())
 			return append(errors, err)
 		}
-		if _, err := tw.Write(contents); err != nil {
-			d.log.Errorf("Unable to close tar writer %s ", err.Error())
-			return append(errors, err)
-		}
 	}
 	if err := tw.Close(); err != nil {
 		d.log.Errorf("Unable to close tar writer %s ", err.Error())
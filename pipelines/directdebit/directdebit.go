@@ -1,22 +1,21 @@
 package directdebit
 
 import (
-	"encoding/json"
 	"fmt"
 	"strings"
-
-	"github.com/google/uuid"
+	"time"
 
 	mysql "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
+	"github.com/masenocturnal/pipefire/internal/sftp"
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 )
 
 // Pipeline is an implementation of a pipeline
 type Pipeline interface {
 	StartListener(listenerError chan error)
-	Execute(string) []error
+	ReconnectDelay() time.Duration
+	Execute(*RunRequest) []error
 	Close() error
 	sftpGet(conf *SftpConfig) error                          // @todo this shouldn't be part of the generic interface
 	sftpTo(conf *SftpConfig) error                           // @todo this shouldn't be part of the generic interface
@@ -25,7 +24,7 @@ type Pipeline interface {
 	pgpEncryptFilesForBank(conf *EncryptFilesConfig) []error // @todo this shouldn't be part of the generic interface
 }
 
-//TasksConfig Configuration
+// TasksConfig Configuration
 type TasksConfig struct {
 	GetFilesFromBFP    *SftpConfig         `json:"getFilesFromBFP"`
 	CleanBFP           *SftpConfig         `json:"cleanBFP"`
@@ -35,6 +34,7 @@ type TasksConfig struct {
 	SftpFilesToBNZ     *SftpConfig         `json:"sftpFilesToBNZ"`
 	ArchiveTransferred *ArchiveConfig      `json:"archiveTransferred"`
 	CleanDirtyFiles    *CleanUpConfig
+	PurgeProcessed     *RetentionConfig `json:"purgeProcessed"`
 }
 
 // PipelineConfig defines the required arguements for the pipeline
@@ -42,15 +42,28 @@ type PipelineConfig struct {
 	Database mysql.Config
 	Rabbitmq *BusConfig
 	Tasks    *TasksConfig
+	Routes   []*RouteConfig `json:"routes"`
+	// Parameters the trigger message is allowed to set
+	Parameters *ParameterSchema `json:"parameters"`
 }
 
 type ddPipeline struct {
 	log           *log.Entry
 	correlationID string
 	consumer      *MessageConsumer
+	publisher     *Publisher
+	request       *RunRequest
+	result        *RunResult
+	// connections are reused by the tasks in a run
+	sftpPool *sftp.Pool
+	// files collected by getFilesFromBFP in this run
+	fetched       []*sftp.FileTransferConfirmation
 	transferlog   *TransferLog
 	encryptionLog *EncryptionLog
+	messageLog    *MessageLog
 	taskConfig    *PipelineConfig
+	// bounds the number of messages handled at the same time
+	workers chan struct{}
 }
 
 // New Pipeline
@@ -58,6 +71,14 @@ func New(c *PipelineConfig) (Pipeline, error) {
 
 	log := log.WithField("Pipeline", "DirectDebit")
 
+	if err := validateRoutes(c.Routes); err != nil {
+		return nil, err
+	}
+
+	if err := c.Parameters.validate(); err != nil {
+		return nil, err
+	}
+
 	var p *ddPipeline = &ddPipeline{
 		taskConfig: c,
 		log:        log,
@@ -72,10 +93,23 @@ func New(c *PipelineConfig) (Pipeline, error) {
 		db.LogMode(true)
 		p.transferlog = NewTransferRecorder(db, p.log)
 		p.encryptionLog = NewEncryptionRecorder(db, p.log)
+		p.messageLog = NewMessageRecorder(db, p.log)
 	}
 
-	if c.Rabbitmq.Host != "" {
+	if c.Rabbitmq != nil && c.Rabbitmq.Host != "" {
+		if err := c.Rabbitmq.validateRetryUser(); err != nil {
+			return nil, err
+		}
+		for _, q := range c.Rabbitmq.Queues {
+			if err := validateTasks(q.Tasks); err != nil {
+				return nil, fmt.Errorf("Queue %s %s", q.Name, err.Error())
+			}
+		}
 		p.consumer = NewConsumer(c.Rabbitmq, p.log)
+		p.workers = make(chan struct{}, c.Rabbitmq.workerCount())
+		if p.messageLog != nil {
+			p.messageLog.claimTimeout = c.Rabbitmq.claimTimeout()
+		}
 	}
 
 	return p, nil
@@ -106,160 +140,95 @@ func connectToDb(dbConfig mysql.Config) (*gorm.DB, error) {
 	return db, err
 }
 
-func (p *ddPipeline) StartListener(listenerError chan error) {
-
-	conn, err := p.consumer.Connect()
-	if err != nil {
-		listenerError <- err
-		// goroutine will block forever if we don't return
-		return
-	}
-
-	if conn == nil || conn.IsClosed() {
-		listenerError <- fmt.Errorf("RabbitMQ Connection is in an unexpected state")
-		// goroutine will block forever if we don't return
-		return
-	}
-
-	// we want to know if the connection get's closed
-	rabbitCloseError := make(chan *amqp.Error)
-	conn.NotifyClose(rabbitCloseError)
-
-	p.log.Debug("Creating Channel")
-	consumerCh, err := conn.Channel()
-	if err != nil {
-		p.log.Errorf("Unable to create Channel : %s ", err.Error())
-		listenerError <- err
-		close(rabbitCloseError)
-
-		// goroutine will block forever if we don't return
-		return
-	}
-
-	p.log.Debug("Creating Exchanges and Queues")
-	// Setup the Exchanges and the Queues
-	if err := p.consumer.Configure(consumerCh); err != nil {
-		listenerError <- err
-		return
-	}
-
-	p.log.Info("Opening Consumer Channel")
-	firehose, err := consumerCh.Consume(
-		p.consumer.config.Queues[0].Name,
-		"pipefire",
-		false,
-		false,
-		false,
-		false,
-		nil)
-
-	if err != nil {
-		// channelError <- err
-		// goroutine will block forever if we don't return
-		listenerError <- err
-		return
-	}
-
-	for {
-		select {
-		case err := <-rabbitCloseError:
-			if conn != nil && !conn.IsClosed() {
-				// can't imagine how it wwuld get to here
-				// but handle it to be safe
-				_ = conn.Close()
-			}
-			_ = consumerCh.Cancel("pipefire", false)
-			p.log.Warning("RabbitMQ Connection has gone away")
-			listenerError <- err
-
-			p.log.Info("Shutting Down Listener")
-			return
-		case msg := <-firehose:
-
-			if msg.Body == nil || len(msg.Body) < 2 {
-				break
-			}
-
-			p.log.Debugf("Message [%s] Correlation ID: %s ", msg.Body, msg.CorrelationId)
-			payload := &TransferFilesPayload{}
+// ReconnectDelay is how long to wait before starting the listener again
+func (p *ddPipeline) ReconnectDelay() time.Duration {
+	return p.consumer.ReconnectDelay()
+}
 
-			err := json.Unmarshal(msg.Body, payload)
-			if err != nil {
-				// @todo move to error queue
-				p.log.Errorf("Unable to unmarshall payload")
-				msg.Reject(false)
-				break
-			}
+// newRun provides a copy of the pipeline so that the state of
+// concurrent runs is kept separate
+func (p *ddPipeline) newRun() *ddPipeline {
+	run := *p
+	return &run
+}
 
-			// de-serialise
-			if payload != nil && payload.Message.CorrelationID == "00000000-0000-0000-0000-000000000000" {
-				payload.Message.CorrelationID = uuid.New().String()
-				// this is useless so make a random one and log it
-				p.log.Warnf("CorrelationID has not been set correctly, setting to a random GUID %s :", payload.Message.CorrelationID)
-				// @todo move to error queue
-			}
+// pipelineTask is a step in the pipeline
+type pipelineTask struct {
+	name string
+	run  func() []error
+	// abort the run if the task fails as later tasks depend on it
+	abort bool
+}
 
-			errList := p.Execute(payload.Message.CorrelationID)
-			if len(errList) > 0 {
-				p.log.Info("Direct Debit Run Finished With Errors")
-				for _, e := range errList {
-					p.log.Errorf("%s ", e.Error())
-				}
-				// don't requeue at this stage
-				msg.Nack(false, false)
-			} else {
-				p.log.Info("Direct Debit Run Completed Successfully")
-				msg.Ack(true)
+// tasks provides the steps of the pipeline in the order they are executed
+func (p *ddPipeline) tasks() []pipelineTask {
+	single := func(task func() error) func() []error {
+		return func() []error {
+			if err := task(); err != nil {
+				return []error{err}
 			}
-
+			return nil
 		}
 	}
-}
-
-// Execute starts the execution of the pipeline
-func (p *ddPipeline) Execute(correlationID string) (errorList []error) {
-
-	p.correlationID = correlationID
-	p.log = log.WithField("correlationId", correlationID)
-
-	// @todo put this into a workflow
-	log.Info("Starting Direct Debit Pipeline")
 
-	// @todo config validation
-	// @todo turn into loop
-	if err := p.getFilesFromBFP(); err != nil {
+	return []pipelineTask{
 		// we need the files from the BFP otherwise there is no point
-		return append(errorList, err)
-	}
-
-	if err := p.cleanBFP(); err != nil {
+		{name: taskGetFilesFromBFP, run: single(p.getFilesFromBFP), abort: true},
 		// not a big deal if cleaning fails..we can clean it up after
-		errorList = append(errorList, err)
-	}
-
-	if err := p.encryptFiles(); err != nil {
-		// We need all the files encrypted
-		// before we continue further
-		return err
+		{name: taskCleanBFP, run: single(p.cleanBFP)},
+		// We need all the files encrypted before we continue further
+		{name: taskEncryptFiles, run: p.encryptFiles, abort: true},
+		// Transfer the files
+		{name: taskSftpFilesToANZ, run: single(p.sftpFilesToANZ)},
+		{name: taskSftpFilesToPx, run: single(p.sftpFilesToPx)},
+		// Archive the folder
+		{name: taskArchiveTransferred, run: single(p.archive)},
+		// remove all the plain text files
+		{name: taskCleanDirtyFiles, run: p.cleanUp},
+		// remove processed files which are past retention
+		{name: taskPurgeProcessed, run: single(p.purgeProcessed)},
 	}
+}
 
-	// Transfer the files
-	if err := p.sftpFilesToANZ(); err != nil {
-		errorList = append(errorList, err)
+// Execute starts the execution of the pipeline
+func (p *ddPipeline) Execute(req *RunRequest) (errorList []error) {
+
+	p.correlationID = req.CorrelationID
+	p.request = req
+	p.log = log.WithField("correlationId", req.CorrelationID)
+	p.result = newRunResult(req.CorrelationID)
+	p.result.DryRun = req.DryRun
+	if !req.BusinessDate.IsZero() {
+		p.result.BusinessDate = req.BusinessDate.Format(defaultDateFormat)
 	}
+	// only the files collected in this run are cleaned
+	p.fetched = nil
+	p.sftpPool = sftp.NewPool(p.log)
+	defer func() {
+		p.sftpPool.Close()
+		p.result.finish(errorList)
+	}()
 
-	if err := p.sftpFilesToPx(); err != nil {
-		errorList = append(errorList, err)
+	// @todo put this into a workflow
+	log.Info("Starting Direct Debit Pipeline")
+	if req.DryRun {
+		p.log.Warn("Dry run, no files will be changed or sent")
 	}
 
-	// Archive the folder
-	if err := p.archive(); err != nil {
-		errorList = append(errorList, err)
-	}
+	// @todo config validation
+	for _, task := range p.tasks() {
+		if !req.includesTask(task.name) {
+			p.log.Debugf("Task %s not requested", task.name)
+			continue
+		}
 
-	// remove all the plain text files
-	if err := p.cleanUp(); err != nil {
-		errorList = append(errorList, err...)
+		if err := task.run(); len(err) > 0 {
+			errorList = append(errorList, err...)
+			if task.abort {
+				p.log.Errorf("Task %s failed, aborting", task.name)
+				return errorList
+			}
+		}
 	}
 
 	if len(errorList) > 0 {
@@ -283,8 +252,7 @@ func (p *ddPipeline) Close() error {
 
 	if p.consumer != nil {
 		p.log.Info("Shutdown RabbitMQ Connection")
-		consumer := *p.consumer
-		if err := consumer.Close(); err != nil {
+		if err := p.consumer.Close(); err != nil {
 			p.log.Warningf("Error closing RabbitMQ connecton, %s", err.Error())
 			return err
 		}
@@ -300,7 +268,11 @@ func (p *ddPipeline) archive() error {
 
 	archiveConfig := p.taskConfig.Tasks.ArchiveTransferred
 	if archiveConfig.Enabled {
-		if err := p.archiveTransferred(archiveConfig); err != nil {
+		if p.request.isDryRun() {
+			p.log.Warn("Dry run, Archiving Transferred Files Skipped")
+			return nil
+		}
+		if err := p.archiveTransferred(p.request.archiveConfig(archiveConfig)); err != nil {
 			p.log.Error(err.Error())
 			return err
 		}
@@ -316,7 +288,11 @@ func (p *ddPipeline) cleanUp() (err []error) {
 	p.log.Info("Clean Up Start")
 	cleanUpConfig := p.taskConfig.Tasks.CleanDirtyFiles
 	if cleanUpConfig.Enabled {
-		err = p.cleanDirtyFiles(cleanUpConfig)
+		if p.request.isDryRun() {
+			p.log.Warn("Dry run, Clean Up Files Skipped")
+			return nil
+		}
+		err = p.cleanDirtyFiles(p.request.cleanUpConfig(cleanUpConfig))
 		p.log.Info("Clean Up Complete")
 	} else {
 		p.log.Warn("Clean Up Files Skipped")
@@ -330,7 +306,11 @@ func (p *ddPipeline) getFilesFromBFP() error {
 	p.log.Info("GetFilesFromBFP Start")
 	bfpSftp := p.taskConfig.Tasks.GetFilesFromBFP
 	if bfpSftp.Enabled {
-		if err := p.sftpGet(bfpSftp); err != nil {
+		if p.request.isDryRun() {
+			// make sure we can connect and show what would be collected
+			return p.sftpList(p.request.sftpConfig(bfpSftp))
+		}
+		if err := p.sftpGet(p.request.sftpConfig(bfpSftp)); err != nil {
 			p.log.Error("Error Collecting the files. Unable to continue without files..Aborting")
 			return err
 		}
@@ -347,7 +327,11 @@ func (p *ddPipeline) cleanBFP() error {
 	p.log.Info("CleanBFP Start")
 	bfpClean := p.taskConfig.Tasks.CleanBFP
 	if bfpClean.Enabled {
-		if err := p.sftpClean(bfpClean); err != nil {
+		if p.request.isDryRun() {
+			p.log.Warn("Dry run, CleanBFP Skipped")
+			return nil
+		}
+		if err := p.sftpClean(p.request.sftpConfig(bfpClean)); err != nil {
 			p.log.Warningf("Unable to clean remote dir %s", err.Error())
 			return err
 		}
@@ -361,7 +345,12 @@ func (p *ddPipeline) encryptFiles() []error {
 	p.log.Info("EncryptFiles Start")
 	encryptionConfig := p.taskConfig.Tasks.EncryptFiles
 	if encryptionConfig != nil && encryptionConfig.Enabled {
-		if err := p.pgpEncryptFilesForBank(encryptionConfig); err != nil {
+		if p.request.isDryRun() {
+			// encrypting records the files as processed
+			p.log.Warn("Dry run, Encrypt Files Skipped")
+			return nil
+		}
+		if err := p.pgpEncryptFilesForBank(p.request.encryptConfig(encryptionConfig)); err != nil {
 			p.log.Error("Unable to encrypt all files..Aborting")
 			return err
 		}
@@ -373,33 +362,36 @@ func (p *ddPipeline) encryptFiles() []error {
 }
 
 func (p *ddPipeline) sftpFilesToANZ() error {
+	return p.sftpFilesToBank(bankANZ, p.taskConfig.Tasks.SftpFilesToANZ)
+}
 
-	p.log.Info("SftpFilesToANZ Start")
+func (p *ddPipeline) sftpFilesToPx() error {
+	return p.sftpFilesToBank(bankPx, p.taskConfig.Tasks.SftpFilesToPx)
+}
 
-	anzSftp := p.taskConfig.Tasks.SftpFilesToANZ
-	if anzSftp.Enabled {
-		if err := p.sftpTo(anzSftp); err != nil {
-			return err
-		}
-		p.log.Info("SftpFilesToANZ Complete")
-		return nil
-	}
-	p.log.Warn("SftpFilesToANZ Skipped")
+// sftpFilesToBank sends the encrypted files to the bank if it's part of the run
+func (p *ddPipeline) sftpFilesToBank(bank string, bankSftp *SftpConfig) error {
+	log := p.log.WithField("Bank", bank)
+	log.Info("SftpFilesToBank Start")
 
-	return nil
-}
+	if bankSftp.Enabled && p.request.includesBank(bank) {
+		conf := p.request.sftpConfig(bankSftp)
 
-func (p *ddPipeline) sftpFilesToPx() error {
-	p.log.Info("SftpFilesToPx Start")
-	pxSftp := p.taskConfig.Tasks.SftpFilesToPx
-	if pxSftp.Enabled {
-		if err := p.sftpTo(pxSftp); err != nil {
+		var err error
+		if p.request.isDryRun() {
+			err = p.sftpDryRun(conf)
+		} else {
+			err = p.sftpTo(conf)
+		}
+		p.result.recordBank(bank, bankSftp.Sftp.Host, true, err)
+		if err != nil {
 			return err
 		}
-		p.log.Info("SftpFilesToPx Complete")
+		log.Info("SftpFilesToBank Complete")
 		return nil
 	}
-	p.log.Warn("SftpFilesToPx Skipped")
+	p.result.recordBank(bank, bankSftp.Sftp.Host, false, nil)
+	log.Warn("SftpFilesToBank Skipped")
 
 	return nil
 }
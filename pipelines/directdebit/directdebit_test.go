@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/masenocturnal/pipefire/internal/config"
+	"github.com/masenocturnal/pipefire/internal/sftp"
 )
 
 func getPipeline(tasksConfig *TasksConfig) (Pipeline, error) {
@@ -40,3 +41,72 @@ func setup(t *testing.T) (*PipelineConfig, error) {
 	}
 	return ddConfig, nil
 }
+
+func TestSftpCleanWithoutCollectedFiles(t *testing.T) {
+	pipeline, err := getPipeline(&TasksConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pipeline.(*ddPipeline)
+
+	// nothing was collected so the pickup directory must not be touched,
+	// the endpoint is unreachable so this fails if a connection is attempted
+	conf := &SftpConfig{RemoteDir: "./Pickup", Enabled: true}
+	conf.Sftp.Host = "192.0.2.1"
+	if err := p.sftpClean(conf); err != nil {
+		t.Errorf("Expected nothing to be cleaned, got %s", err.Error())
+	}
+}
+
+func TestSftpCleanProcessedDirInsidePickup(t *testing.T) {
+	pipeline, err := getPipeline(&TasksConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pipeline.(*ddPipeline)
+	p.fetched = []*sftp.FileTransferConfirmation{{RemoteFileName: "Pickup/file.csv", LocalHash: "00"}}
+
+	conf := &SftpConfig{RemoteDir: "./Pickup", ProcessedDir: "./Pickup/Processed", Enabled: true}
+	conf.Sftp.Host = "192.0.2.1"
+	if err := p.sftpClean(conf); err == nil {
+		t.Error("Expected a processed directory inside the pickup directory to be rejected")
+	}
+}
+
+func TestSftpConnectPerFile(t *testing.T) {
+	tests := []struct {
+		connection string
+		perFile    bool
+		valid      bool
+	}{
+		{"", false, true},
+		{connectionPerRun, false, true},
+		{connectionPerFile, true, true},
+		{"perDay", false, false},
+	}
+	for _, tt := range tests {
+		conf := &SftpConfig{Connection: tt.connection}
+		perFile, err := conf.connectPerFile()
+		if (err == nil) != tt.valid {
+			t.Errorf("Connection %q: unexpected error %v", tt.connection, err)
+		}
+		if perFile != tt.perFile {
+			t.Errorf("Connection %q: expected perFile %t", tt.connection, tt.perFile)
+		}
+	}
+}
+
+func TestExecuteForgetsCollectedFiles(t *testing.T) {
+	pipeline, err := getPipeline(&TasksConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pipeline.(*ddPipeline)
+	p.fetched = []*sftp.FileTransferConfirmation{{RemoteFileName: "Pickup/file.csv", LocalHash: "00"}}
+
+	// a run which doesn't collect anything mustn't clean the files from the last run
+	p.Execute(&RunRequest{CorrelationID: "abc-123", Tasks: []string{taskPurgeProcessed}})
+	if len(p.fetched) != 0 {
+		t.Errorf("Expected the files from the previous run to be forgotten, got %d", len(p.fetched))
+	}
+}
@@ -174,8 +174,8 @@ func (p ddPipeline) encryptFilesInDir(cryptoProvider crypto.Provider, srcDir str
 
 			txn = p.encryptionLog.Conn.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
 
-			// encrypt file
-			err = cryptoProvider.EncryptFile(plainText, cryptFile)
+			// encrypt file, hashing the output as it's written
+			record.EncryptedFileHash, err = cryptoProvider.EncryptFileWithHash(plainText, cryptFile)
 			if err != nil {
 				p.log.Warningf("Error encrypting file %s : %s", plainText, err.Error())
 				errorList = append(errorList, err)
@@ -183,8 +183,6 @@ func (p ddPipeline) encryptFilesInDir(cryptoProvider crypto.Provider, srcDir str
 				continue
 			}
 
-			record.EncryptedFileHash, _ = hashFile(cryptFile)
-
 			// get the encryption key
 			recipientKey, err := cryptoProvider.GetEncryptionKey()
 			if err != nil {
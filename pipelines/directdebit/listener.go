@@ -0,0 +1,354 @@
+package directdebit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+func (p *ddPipeline) StartListener(listenerError chan error) {
+
+	// record the failure so that the next attempt backs off
+	listenerFailed := func(err error) {
+		p.consumer.disconnected(err)
+		listenerError <- err
+	}
+
+	conn, err := p.consumer.Connect()
+	if err != nil {
+		listenerFailed(err)
+		// goroutine will block forever if we don't return
+		return
+	}
+
+	if conn == nil || conn.IsClosed() {
+		listenerFailed(fmt.Errorf("RabbitMQ Connection is in an unexpected state"))
+		// goroutine will block forever if we don't return
+		return
+	}
+
+	// we want to know if the connection get's closed
+	rabbitCloseError := make(chan *amqp.Error, 1)
+	conn.NotifyClose(rabbitCloseError)
+
+	p.log.Debug("Creating Channel")
+	configCh, err := conn.Channel()
+	if err != nil {
+		p.log.Errorf("Unable to create Channel : %s ", err.Error())
+		_ = conn.Close()
+		listenerFailed(err)
+
+		// goroutine will block forever if we don't return
+		return
+	}
+
+	p.log.Debug("Creating Exchanges and Queues")
+	// Setup the Exchanges and the Queues
+	if err := p.consumer.Configure(configCh); err != nil {
+		if IsDeclarationError(err) {
+			p.log.Error(err.Error())
+		}
+		_ = conn.Close()
+		listenerFailed(err)
+		return
+	}
+	_ = configCh.Close()
+
+	p.log.Debug("Creating Publishing Channel")
+	publishCh, err := conn.Channel()
+	if err != nil {
+		p.log.Errorf("Unable to create Channel : %s ", err.Error())
+		_ = conn.Close()
+		listenerFailed(err)
+		return
+	}
+
+	p.publisher, err = NewPublisher(publishCh, p.log)
+	if err != nil {
+		_ = conn.Close()
+		listenerFailed(err)
+		return
+	}
+
+	// each queue has it's own channel and goroutine so that
+	// a slow queue doesn't hold up the others
+	queues := p.consumer.config.consumedQueues()
+	consumerError := make(chan error, len(queues))
+	for _, qConfig := range queues {
+		if err := p.startConsumer(conn, qConfig, consumerError); err != nil {
+			// goroutine will block forever if we don't return
+			_ = conn.Close()
+			listenerFailed(err)
+			return
+		}
+	}
+
+	p.consumer.connected()
+
+	select {
+	case err := <-rabbitCloseError:
+		p.log.Warning("RabbitMQ Connection has gone away")
+		if err == nil {
+			// closed without an error
+			listenerFailed(fmt.Errorf("RabbitMQ Connection closed"))
+		} else {
+			listenerFailed(err)
+		}
+	case err := <-consumerError:
+		p.log.Warningf("RabbitMQ Consumer has stopped: %s", err.Error())
+		// take the remaining consumers down with it so that everything is re-established
+		_ = conn.Close()
+		listenerFailed(err)
+	}
+	p.log.Info("Shutting Down Listener")
+}
+
+// startConsumer opens a channel for the queue and handles the deliveries in a separate goroutine
+func (p *ddPipeline) startConsumer(conn *amqp.Connection, qConfig *QueueConfig, consumerError chan error) error {
+	log := p.log.WithField("Queue", qConfig.Name)
+
+	log.Info("Opening Consumer Channel")
+	ch, err := conn.Channel()
+	if err != nil {
+		log.Errorf("Unable to create Channel : %s ", err.Error())
+		return err
+	}
+
+	prefetch := p.consumer.config.prefetchCount(qConfig)
+	log.Debugf("Prefetch count %d", prefetch)
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return err
+	}
+
+	deliveries, err := ch.Consume(
+		qConfig.Name,
+		qConfig.consumerTag(),
+		false,
+		false,
+		false,
+		false,
+		nil)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for msg := range deliveries {
+			// wait for a free worker
+			p.workers <- struct{}{}
+
+			if conn.IsClosed() {
+				// the message is unacknowledged so the broker will deliver it again
+				<-p.workers
+				continue
+			}
+
+			go func(msg amqp.Delivery) {
+				defer func() {
+					<-p.workers
+				}()
+				p.newRun().handleMessage(qConfig, msg)
+			}(msg)
+		}
+		// deliveries are closed when the channel or connection goes away
+		consumerError <- fmt.Errorf("Deliveries for queue %s have stopped", qConfig.Name)
+	}()
+
+	return nil
+}
+
+// handleMessage runs the pipeline for a single message and acknowledges it.
+// Messages which can't be processed are moved to the error exchange
+func (p *ddPipeline) handleMessage(qConfig *QueueConfig, msg amqp.Delivery) {
+
+	if msg.Body == nil || len(msg.Body) < 2 {
+		p.moveToErrorExchange(msg, resultUnparseable, msg.CorrelationId, []error{fmt.Errorf("Message body is empty")})
+		return
+	}
+
+	if err := p.consumer.config.MessageAuth.authenticate(msg); err != nil {
+		p.log.Errorf("Unable to verify the message: %s", err.Error())
+		p.moveToErrorExchange(msg, resultUnverified, msg.CorrelationId, []error{err})
+		return
+	}
+
+	p.log.Debugf("Message [%s] Correlation ID: %s ", msg.Body, msg.CorrelationId)
+	payload := &TransferFilesPayload{}
+
+	err := json.Unmarshal(msg.Body, payload)
+	if err != nil {
+		p.log.Errorf("Unable to unmarshall payload")
+		p.moveToErrorExchange(msg, resultUnparseable, msg.CorrelationId, []error{err})
+		return
+	}
+
+	// de-serialise
+	if payload.Message.CorrelationID == "00000000-0000-0000-0000-000000000000" {
+		payload.Message.CorrelationID = uuid.New().String()
+		// this is useless so make a random one and log it
+		p.log.Warnf("CorrelationID has not been set correctly, setting to a random GUID %s :", payload.Message.CorrelationID)
+	}
+
+	// queues bound to a set of tasks ignore the routing table
+	tasks := qConfig.Tasks
+	if len(tasks) == 0 {
+		tasks, err = route(p.taskConfig.Routes, payload)
+		if err != nil {
+			p.log.Error(err.Error())
+			p.moveToErrorExchange(msg, resultUnroutable, payload.Message.CorrelationID, []error{err})
+			return
+		}
+	}
+
+	req, err := p.taskConfig.Parameters.request(payload, tasks)
+	if err != nil {
+		p.log.Error(err.Error())
+		p.moveToErrorExchange(msg, resultInvalid, payload.Message.CorrelationID, []error{err})
+		return
+	}
+
+	if req.DryRun {
+		// a dry run doesn't count as processing the message
+		p.log.Infof("Dry run requested for %s", req.CorrelationID)
+		p.Execute(req)
+		msg.Ack(false)
+		p.reply(msg, p.result)
+		return
+	}
+
+	claimed, err := p.claimMessage(msg, payload)
+	if err != nil {
+		p.log.Errorf("Unable to claim the message: %s", err.Error())
+		p.retryOrMoveToErrorExchange(qConfig, msg, payload.Message.CorrelationID, []error{err})
+		return
+	}
+	if !claimed {
+		// duplicate, acknowledge it so that it isn't delivered again
+		msg.Ack(false)
+		p.replyToDuplicate(msg, payload.Message.CorrelationID)
+		return
+	}
+
+	errList := p.Execute(req)
+	if len(errList) == 0 && p.result.Status != statusCompleted {
+		// files can fail without the task returning an error
+		errList = p.result.failures()
+	}
+
+	if p.messageLog != nil {
+		if err := p.messageLog.Finish(payload.Message.CorrelationID, errList); err != nil {
+			p.log.Errorf("Unable to record the outcome of the message: %s", err.Error())
+		}
+	}
+
+	if len(errList) > 0 {
+		p.log.Info("Direct Debit Run Finished With Errors")
+		for _, e := range errList {
+			p.log.Errorf("%s ", e.Error())
+		}
+		if p.retryOrMoveToErrorExchange(qConfig, msg, payload.Message.CorrelationID, errList) {
+			// the result is published once there are no more attempts
+			return
+		}
+	} else {
+		p.log.Info("Direct Debit Run Completed Successfully")
+		msg.Ack(false)
+		p.reply(msg, p.result)
+	}
+
+	if err := p.consumer.PublishRunResult(p.publisher, p.result); err != nil {
+		p.log.Errorf("Unable to publish the run result: %s", err.Error())
+	}
+}
+
+// reply sends the result to the caller if the message is a request.
+// Retried messages aren't replied to until the final attempt
+func (p *ddPipeline) reply(msg amqp.Delivery, result *RunResult) {
+	if err := p.consumer.PublishReply(p.publisher, msg, result); err != nil {
+		p.log.Errorf("Unable to reply to %s: %s", msg.ReplyTo, err.Error())
+	}
+}
+
+// replyToDuplicate lets a caller which sent the message again know the outcome of the
+// earlier run, or that it's still in progress
+func (p *ddPipeline) replyToDuplicate(msg amqp.Delivery, correlationID string) {
+	if msg.ReplyTo == "" {
+		return
+	}
+	rec, err := p.messageLog.Find(correlationID)
+	if err != nil {
+		p.log.Errorf("Unable to find the outcome of message %s to reply with: %s", correlationID, err.Error())
+		return
+	}
+	p.reply(msg, previousResult(rec))
+}
+
+// claimMessage records the message as in progress so that duplicates aren't run.
+// Runs which failed previously are only run again if the message is a deliberate retry
+func (p *ddPipeline) claimMessage(msg amqp.Delivery, payload *TransferFilesPayload) (bool, error) {
+	if p.messageLog == nil {
+		// without a database we can't tell
+		return true, nil
+	}
+
+	rec := &ProcessedMessage{
+		CorrelationID: payload.Message.CorrelationID,
+		MessageID:     msg.MessageId,
+		MessageType:   strings.Join(payload.MessageType, ","),
+		Task:          payload.Message.Task,
+	}
+	retry := payload.Message.Retry || attempt(msg) > 1
+
+	return p.messageLog.Claim(rec, retry, msg.Redelivered)
+}
+
+// retryOrMoveToErrorExchange schedules another attempt of a failed run and reports if it did.
+// Once the attempts are exhausted the message is moved to the error exchange
+func (p *ddPipeline) retryOrMoveToErrorExchange(qConfig *QueueConfig, msg amqp.Delivery, correlationID string, errs []error) bool {
+	current := attempt(msg)
+	retry := p.consumer.config.Retry
+
+	if retry.shouldRetry(current) {
+		err := p.consumer.PublishRetry(p.publisher, qConfig, msg, correlationID, errs)
+		if err == nil {
+			p.log.Warnf("Attempt %d of %d failed, message will be retried", current, retry.MaxAttempts)
+			msg.Ack(false)
+			return true
+		}
+		p.log.Errorf("Unable to schedule a retry: %s", err.Error())
+	} else if retry != nil {
+		p.log.Errorf("Attempt %d of %d failed, no more retries", current, retry.MaxAttempts)
+	}
+
+	p.moveToErrorExchange(msg, resultFailed, correlationID, errs)
+	return false
+}
+
+// moveToErrorExchange publishes the message to the error exchange and removes it from the queue.
+// If the error exchange is unavailable the message is rejected
+func (p *ddPipeline) moveToErrorExchange(msg amqp.Delivery, result string, correlationID string, errs []error) {
+	if err := p.consumer.PublishError(p.publisher, msg, result, correlationID, errs); err != nil {
+		p.log.Errorf("Unable to move message to the error exchange: %s", err.Error())
+		msg.Nack(false, false)
+		return
+	}
+	p.log.Warnf("Message moved to error exchange %s", p.consumer.config.ErrorExchange)
+	msg.Ack(false)
+
+	if result == resultUnverified {
+		// don't tell a sender we don't trust why it was refused
+		return
+	}
+
+	// the caller only gets a reply once there are no more attempts
+	outcome := p.result
+	if outcome == nil {
+		// the run never started so let the caller know why
+		outcome = newRunResult(correlationID)
+		outcome.finish(errs)
+	}
+	p.reply(msg, outcome)
+}
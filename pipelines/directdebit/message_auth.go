@@ -0,0 +1,84 @@
+package directdebit
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/masenocturnal/pipefire/internal/crypto"
+	"github.com/streadway/amqp"
+)
+
+// supported trigger message signatures
+const (
+	signatureHMAC = "hmac"
+	signaturePGP  = "pgp"
+)
+
+const defaultSignatureHeader = "x-signature"
+
+//MessageAuthConfig defines how trigger messages are authenticated.
+//Messages which can't be verified are moved to the error exchange
+type MessageAuthConfig struct {
+	// Signature is either hmac, pgp or empty to not require a signature
+	Signature string `json:"signature"`
+	// SignatureHeader is the header carrying the signature, defaults to x-signature.
+	// HMAC-SHA256 signatures are hex encoded, PGP signatures are ASCII armoured and detached
+	SignatureHeader string `json:"signatureHeader"`
+	// HmacKeyFile contains the shared secret
+	HmacKeyFile string `json:"hmacKeyFile"`
+	// PublicKey is the ASCII armoured key of the sender
+	PublicKey string `json:"publicKey"`
+	// AllowedAppIDs restricts the app_id property of the message if set
+	AllowedAppIDs []string `json:"allowedAppIds"`
+	// AllowedUserIDs restricts the user_id property of the message if set.
+	// RabbitMQ validates the user_id is the user which published the message.
+	// Retries are published by pipefire so it's own user needs to be allowed too, the
+	// pipeline won't start if it isn't
+	AllowedUserIDs []string `json:"allowedUserIds"`
+}
+
+// authenticate verifies the message came from an allowed sender
+func (a *MessageAuthConfig) authenticate(msg amqp.Delivery) error {
+	if a == nil {
+		return nil
+	}
+
+	if len(a.AllowedAppIDs) > 0 && !contains(a.AllowedAppIDs, msg.AppId) {
+		return fmt.Errorf("app_id '%s' is not allowed", msg.AppId)
+	}
+
+	if len(a.AllowedUserIDs) > 0 && !contains(a.AllowedUserIDs, msg.UserId) {
+		return fmt.Errorf("user_id '%s' is not allowed", msg.UserId)
+	}
+
+	if a.Signature == "" {
+		return nil
+	}
+
+	header := a.SignatureHeader
+	if header == "" {
+		header = defaultSignatureHeader
+	}
+	signature, ok := msg.Headers[header].(string)
+	if !ok || signature == "" {
+		return fmt.Errorf("Message is not signed, expected a signature in the %s header", header)
+	}
+
+	switch strings.ToLower(a.Signature) {
+	case signatureHMAC:
+		return crypto.VerifyHMAC(a.HmacKeyFile, msg.Body, signature)
+	case signaturePGP:
+		_, err := crypto.VerifyDetachedSignature(a.PublicKey, msg.Body, signature)
+		return err
+	}
+	return fmt.Errorf("Unsupported signature type %s", a.Signature)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
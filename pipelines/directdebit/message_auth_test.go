@@ -0,0 +1,58 @@
+package directdebit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestAuthenticate(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "hmac.key")
+	if err := ioutil.WriteFile(keyFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"message":{"task":"transfer"}}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	var none *MessageAuthConfig
+	if err := none.authenticate(amqp.Delivery{Body: body}); err != nil {
+		t.Errorf("Expected no verification without config, got %s", err.Error())
+	}
+
+	auth := &MessageAuthConfig{
+		Signature:      signatureHMAC,
+		HmacKeyFile:    keyFile,
+		AllowedAppIDs:  []string{"bfp"},
+		AllowedUserIDs: []string{"pipefire"},
+	}
+
+	tests := []struct {
+		name  string
+		msg   amqp.Delivery
+		valid bool
+	}{
+		{"signed", amqp.Delivery{AppId: "bfp", UserId: "pipefire", Body: body, Headers: amqp.Table{"x-signature": signature}}, true},
+		{"unsigned", amqp.Delivery{AppId: "bfp", UserId: "pipefire", Body: body}, false},
+		{"tampered", amqp.Delivery{AppId: "bfp", UserId: "pipefire", Body: []byte("{}"), Headers: amqp.Table{"x-signature": signature}}, false},
+		{"unknown app", amqp.Delivery{AppId: "other", UserId: "pipefire", Body: body, Headers: amqp.Table{"x-signature": signature}}, false},
+		{"unknown user", amqp.Delivery{AppId: "bfp", UserId: "guest", Body: body, Headers: amqp.Table{"x-signature": signature}}, false},
+	}
+
+	for _, tt := range tests {
+		err := auth.authenticate(tt.msg)
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected message to be verified, got %s", tt.name, err.Error())
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected message to be rejected", tt.name)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package directdebit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	mysql "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// status of a trigger message
+const (
+	messageInProgress = "in_progress"
+	messageSucceeded  = "succeeded"
+	messageFailed     = "failed"
+)
+
+// defaultClaimTimeout is how long a claim is held before another delivery of the message can take it over
+const defaultClaimTimeout = 2 * time.Hour
+
+// MessageRecorder provides a mechanism to ensure a trigger message is only processed once
+type MessageRecorder interface {
+	Claim(rec *ProcessedMessage, retry bool, redelivered bool) (bool, error)
+	Finish(correlationID string, errs []error) error
+}
+
+//TableName sets the table name to ProcessedMessage
+func (ProcessedMessage) TableName() string {
+	return "ProcessedMessage"
+}
+
+//ProcessedMessage Maps to a row in the ProcessedMessage table
+type ProcessedMessage struct {
+	gorm.Model
+	CorrelationID string `gorm:"primary_key"`
+	MessageID     string
+	MessageType   string
+	Task          string
+	Status        string
+	Attempts      int
+	LocalHostID   string
+	RunStart      time.Time
+	RunEnd        *time.Time
+	RunErrors     string
+}
+
+//MessageLog Stores a database log
+type MessageLog struct {
+	Conn *gorm.DB
+	log  *log.Entry
+	// claims older than this are treated as abandoned by a process which died
+	claimTimeout time.Duration
+}
+
+// NewMessageRecorder provides a service which records processed messages in the database
+func NewMessageRecorder(Conn *gorm.DB, log *log.Entry) *MessageLog {
+
+	messageLog := &MessageLog{
+		Conn:         Conn,
+		log:          log,
+		claimTimeout: defaultClaimTimeout,
+	}
+
+	return messageLog
+}
+
+//Claim records that this process is running the message.
+//It returns false if the message has already been processed, is in progress or
+//failed previously and the message isn't a deliberate retry or a redelivery.
+//A retried or redelivered message whose claim is still held returns an error so that it's
+//retried later rather than being dropped, the process holding the claim may have lost it's channel
+func (m *MessageLog) Claim(rec *ProcessedMessage, retry bool, redelivered bool) (bool, error) {
+
+	// create a synchronous transaction so that only 1 process can claim the message
+	txn := m.Conn.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+
+	hostName, _ := os.Hostname()
+	existing := &ProcessedMessage{}
+	result := txn.Where("correlation_id = ?", rec.CorrelationID).First(existing)
+
+	if result.RecordNotFound() {
+		rec.Status = messageInProgress
+		rec.Attempts = 1
+		rec.LocalHostID = hostName
+		rec.RunStart = time.Now()
+
+		if err := txn.Create(rec).Error; err != nil {
+			txn.Rollback()
+			if dbErr, ok := err.(*mysql.MySQLError); ok && dbErr.Number == 1062 {
+				// someone beat us to it
+				m.log.Warnf("Message %s has been claimed by another process", rec.CorrelationID)
+				return false, nil
+			}
+			return false, err
+		}
+		return true, txn.Commit().Error
+	}
+
+	if result.Error != nil {
+		txn.Rollback()
+		return false, result.Error
+	}
+
+	staleBefore := time.Now().Add(-m.claimTimeout)
+	if ok, reason := claimable(existing, retry, redelivered, staleBefore); !ok {
+		txn.Rollback()
+		if (retry || redelivered) && existing.Status == messageInProgress {
+			return false, fmt.Errorf("Message %s was delivered again while %s", rec.CorrelationID, reason)
+		}
+		m.log.Warnf("Message %s will not be processed: %s", rec.CorrelationID, reason)
+		return false, nil
+	}
+	if existing.Status == messageInProgress {
+		m.log.Warnf("Taking over the claim on message %s from %s, it started at %s", rec.CorrelationID, existing.LocalHostID, existing.RunStart)
+	}
+
+	update := txn.
+		Model(existing).
+		UpdateColumns(map[string]interface{}{
+			"status":        messageInProgress,
+			"attempts":      existing.Attempts + 1,
+			"local_host_id": hostName,
+			"run_start":     time.Now(),
+			"run_end":       nil,
+			"run_errors":    "",
+		})
+	if err := update.Error; err != nil {
+		txn.Rollback()
+		return false, err
+	}
+
+	m.log.Infof("Retrying message %s, attempt %d", rec.CorrelationID, existing.Attempts+1)
+	return true, txn.Commit().Error
+}
+
+//Find provides the record of a message which has been claimed
+func (m *MessageLog) Find(correlationID string) (*ProcessedMessage, error) {
+	rec := &ProcessedMessage{}
+	if err := m.Conn.Where("correlation_id = ?", correlationID).First(rec).Error; err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//Finish records the outcome of the run for the message
+func (m *MessageLog) Finish(correlationID string, errs []error) error {
+
+	status := messageSucceeded
+	errorMessages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		errorMessages = append(errorMessages, e.Error())
+	}
+	if len(errs) > 0 {
+		status = messageFailed
+	}
+
+	result := m.Conn.
+		Model(&ProcessedMessage{}).
+		Where("correlation_id = ?", correlationID).
+		UpdateColumns(map[string]interface{}{
+			"status":     status,
+			"run_end":    time.Now(),
+			"run_errors": strings.Join(errorMessages, "\n"),
+		})
+	if err := result.Error; err != nil {
+		m.log.Error(err.Error())
+		return err
+	}
+	m.log.Debugf("Rows Updated %d ", result.RowsAffected)
+	return nil
+}
+
+// claimable determines if a message which has been seen before can be run again.
+// A claim which started before staleBefore is abandoned and can be taken over by a
+// retry or a redelivery of the message
+func claimable(existing *ProcessedMessage, retry bool, redelivered bool, staleBefore time.Time) (bool, string) {
+	switch existing.Status {
+	case messageSucceeded:
+		return false, "it has already been processed successfully"
+	case messageInProgress:
+		if !existing.RunStart.Before(staleBefore) {
+			return false, fmt.Sprintf("it is in progress on %s", existing.LocalHostID)
+		}
+		if !retry && !redelivered {
+			return false, fmt.Sprintf("it was claimed by %s at %s and is not a retry", existing.LocalHostID, existing.RunStart)
+		}
+	case messageFailed:
+		// a redelivery means the failed run couldn't acknowledge the message or schedule a retry
+		if !retry && !redelivered {
+			return false, "it failed previously and is not a retry"
+		}
+	}
+	return true, ""
+}
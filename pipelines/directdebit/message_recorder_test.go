@@ -0,0 +1,58 @@
+package directdebit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClaimable(t *testing.T) {
+
+	staleBefore := time.Now().Add(-defaultClaimTimeout)
+	running := time.Now().Add(-time.Minute)
+	abandoned := staleBefore.Add(-time.Minute)
+
+	cases := []struct {
+		status      string
+		runStart    time.Time
+		retry       bool
+		redelivered bool
+		expected    bool
+	}{
+		{messageSucceeded, running, false, false, false},
+		{messageSucceeded, running, true, false, false},
+		{messageSucceeded, abandoned, false, true, false},
+		{messageInProgress, running, false, false, false},
+		{messageInProgress, running, true, false, false},
+		{messageInProgress, running, false, true, false},
+		{messageInProgress, abandoned, false, false, false},
+		{messageInProgress, abandoned, false, true, true},
+		{messageInProgress, abandoned, true, false, true},
+		{messageFailed, running, false, false, false},
+		{messageFailed, running, true, false, true},
+		{messageFailed, running, false, true, true},
+	}
+
+	for _, c := range cases {
+		existing := &ProcessedMessage{
+			CorrelationID: "abc-123",
+			Status:        c.status,
+			RunStart:      c.runStart,
+		}
+		ok, reason := claimable(existing, c.retry, c.redelivered, staleBefore)
+		if ok != c.expected {
+			t.Errorf("Status %s started %s with retry %v redelivered %v: expected %v got %v", c.status, c.runStart, c.retry, c.redelivered, c.expected, ok)
+		}
+		if !ok && reason == "" {
+			t.Errorf("Status %s with retry %v: expected a reason", c.status, c.retry)
+		}
+	}
+}
+
+func TestClaimTimeout(t *testing.T) {
+	if timeout := (BusConfig{}).claimTimeout(); timeout != defaultClaimTimeout {
+		t.Errorf("Expected the default claim timeout, got %s", timeout)
+	}
+	if timeout := (BusConfig{ClaimTimeout: 30}).claimTimeout(); timeout != 30*time.Minute {
+		t.Errorf("Expected 30 minutes, got %s", timeout)
+	}
+}
@@ -1,7 +1,12 @@
 package directdebit
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
@@ -16,6 +21,30 @@ type BusConfig struct {
 	Vhost     string
 	Exchanges []*ExchangeConfig
 	Queues    []*QueueConfig `json:"queues"`
+	// ErrorExchange receives messages which can't be processed or whose run failed
+	ErrorExchange   string `json:"errorExchange"`
+	ErrorRoutingKey string `json:"errorRoutingKey"`
+	// EventExchange receives the BankTransferCompleted and BankTransferFailed events
+	EventExchange string `json:"eventExchange"`
+	// Retry failed runs, if this isn't set failed runs go straight to the ErrorExchange
+	Retry *RetryConfig `json:"retry"`
+	// Workers is the number of messages handled at the same time across all queues.
+	// Runs share the local working directories so this defaults to 1
+	Workers int `json:"workers"`
+	// PrefetchCount is used for queues which don't set their own
+	PrefetchCount int `json:"prefetchCount"`
+	// ClaimTimeout is the number of minutes before a message which is in progress is
+	// considered abandoned and can be taken over when it's redelivered. Defaults to 120
+	ClaimTimeout int `json:"claimTimeout"`
+	// TLS connects using amqps
+	TLS *TLSConfig `json:"tls"`
+	// AuthMechanism is PLAIN (default) or EXTERNAL to authenticate with the TLS client certificate
+	AuthMechanism string `json:"authMechanism"`
+	// Hosts to rotate through when reconnecting, either host or host:port. Host is used if empty
+	Hosts     []string         `json:"hosts"`
+	Reconnect *ReconnectConfig `json:"reconnect"`
+	// MessageAuth verifies the sender of trigger messages
+	MessageAuth *MessageAuthConfig `json:"messageAuth"`
 }
 
 //ExchangeConfig RabbbitMQ Exchange configuration
@@ -23,6 +52,7 @@ type ExchangeConfig struct {
 	Name         string
 	ExchangeType string
 	Durable      bool
+	Args         *ExchangeArgs `json:"args"`
 }
 
 //QueueConfig RabbitMQ Queue definition
@@ -32,8 +62,14 @@ type QueueConfig struct {
 	DeleteOnUnused bool            `json:"deleteOnUnused"`
 	Exclusive      bool            `json:"exclusive"`
 	NoWait         bool            `json:"noWait"`
-	Args           string          `json:"args"`
+	Args           *QueueArgs      `json:"args"`
 	Bindings       []BindingConfig `json:"bindings"`
+	// Consume the queue. If no queues are consumed the first queue is used
+	Consume       bool   `json:"consume"`
+	ConsumerTag   string `json:"consumerTag"`
+	PrefetchCount int    `json:"prefetchCount"`
+	// Tasks binds the queue to a set of tasks instead of using the routing table
+	Tasks []string `json:"tasks"`
 }
 
 //BindingConfig Queue/Exchange Bindings
@@ -42,6 +78,95 @@ type BindingConfig struct {
 	Exchange   string
 }
 
+//QueueArgs optional arguments applied when the queue is declared
+type QueueArgs struct {
+	// x-dead-letter-exchange
+	DeadLetterExchange string `json:"deadLetterExchange"`
+	// x-dead-letter-routing-key
+	DeadLetterRoutingKey string `json:"deadLetterRoutingKey"`
+	// x-message-ttl in milliseconds
+	MessageTTL int64 `json:"messageTTL"`
+	// x-max-length
+	MaxLength int64 `json:"maxLength"`
+	// x-overflow i.e drop-head, reject-publish or reject-publish-dlx
+	Overflow string `json:"overflow"`
+	// x-queue-type i.e classic or quorum
+	QueueType string `json:"queueType"`
+}
+
+//ExchangeArgs optional arguments applied when the exchange is declared
+type ExchangeArgs struct {
+	// alternate-exchange receives messages which can't be routed
+	AlternateExchange string `json:"alternateExchange"`
+}
+
+//UnmarshalJSON allows the legacy "args": "" configuration to be read
+func (a *QueueArgs) UnmarshalJSON(data []byte) error {
+	if string(data) == `""` {
+		return nil
+	}
+	// alias the type so that we don't recurse
+	type queueArgs QueueArgs
+	return json.Unmarshal(data, (*queueArgs)(a))
+}
+
+// table converts the arguments to the form expected by QueueDeclare
+func (a *QueueArgs) table() amqp.Table {
+	if a == nil {
+		return nil
+	}
+
+	args := amqp.Table{}
+	if a.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = a.DeadLetterExchange
+	}
+	if a.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = a.DeadLetterRoutingKey
+	}
+	if a.MessageTTL > 0 {
+		args["x-message-ttl"] = a.MessageTTL
+	}
+	if a.MaxLength > 0 {
+		args["x-max-length"] = a.MaxLength
+	}
+	if a.Overflow != "" {
+		args["x-overflow"] = a.Overflow
+	}
+	if a.QueueType != "" {
+		args["x-queue-type"] = a.QueueType
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// table converts the arguments to the form expected by ExchangeDeclare
+func (a *ExchangeArgs) table() amqp.Table {
+	if a == nil {
+		return nil
+	}
+
+	args := amqp.Table{}
+	if a.AlternateExchange != "" {
+		args["alternate-exchange"] = a.AlternateExchange
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// validate checks the queue definition is acceptable to the broker
+func (q QueueConfig) validate() error {
+	if q.Args != nil && q.Args.QueueType == "quorum" {
+		if !q.Durable || q.Exclusive || q.DeleteOnUnused {
+			return fmt.Errorf("Quorum queue %s must be durable, not exclusive and not deleted when unused", q.Name)
+		}
+	}
+	return nil
+}
+
 //QueueClient Consumes a message for the pipeline
 type QueueClient interface {
 	Connect()
@@ -56,6 +181,9 @@ type MessageConsumer struct {
 	ConsumerChannel *amqp.Channel
 	log             *log.Entry
 	Shutdown        bool
+	// consecutive connection failures
+	failures int
+	mutex    sync.Mutex
 }
 
 //TransferFilesPayload represents the payload received from the message bus
@@ -69,8 +197,23 @@ type MessagePayload struct {
 	Task          string `json:"task"`
 	StartDate     string `json:"start_date"`
 	CorrelationID string `json:"correlationId"`
+	// Retry a run for this correlationId which has previously failed
+	Retry bool `json:"retry"`
+	// Banks limits the run to a subset of the banks
+	Banks []string `json:"banks"`
+	// DryRun reports what would be sent without changing anything
+	DryRun bool `json:"dryRun"`
 }
 
+// results recorded against messages moved to the error exchange
+const (
+	resultUnparseable = "unparseable"
+	resultUnroutable  = "unroutable"
+	resultUnverified  = "unverified"
+	resultInvalid     = "invalid"
+	resultFailed      = "failed"
+)
+
 //BusError indicates there is a connection issue with the bus and an action to take
 type BusError struct {
 	Msg    string
@@ -91,14 +234,41 @@ func NewConsumer(config *BusConfig, log *log.Entry) *MessageConsumer {
 func (c *MessageConsumer) Connect() (*amqp.Connection, error) {
 
 	var err error
-	uri := c.config.ConnectionString()
-	c.log.Info("Try and connect to RabbitMQ")
-	conn, err := amqp.Dial(uri)
+	address := c.address()
+	uri := c.config.connectionStringFor(address)
+
+	amqpConfig := amqp.Config{
+		Heartbeat: 10 * time.Second,
+		Locale:    "en_US",
+	}
+
+	if c.config.TLS != nil && c.config.TLS.Enabled {
+		amqpConfig.TLSClientConfig, err = c.config.TLS.clientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch c.config.authMechanism() {
+	case authPlain:
+		// the credentials in the uri are used
+	case authExternal:
+		if amqpConfig.TLSClientConfig == nil || len(amqpConfig.TLSClientConfig.Certificates) == 0 {
+			return nil, fmt.Errorf("%s authentication requires TLS with a client certificate", authExternal)
+		}
+		amqpConfig.SASL = []amqp.Authentication{&externalAuth{}}
+	default:
+		return nil, fmt.Errorf("Unsupported authentication mechanism %s", c.config.AuthMechanism)
+	}
+
+	c.log.Infof("Try and connect to RabbitMQ at %s", address)
+	conn, err := amqp.DialConfig(uri, amqpConfig)
 	if err != nil {
 		return nil, err
 	}
 
 	c.log.Info("Connected")
+	c.Connection = conn
 	return conn, err
 }
 
@@ -116,26 +286,34 @@ func (c *MessageConsumer) Configure(ch *amqp.Channel) (err error) {
 				false,           // auto-deleted
 				false,           // internal
 				false,           // no-wait
-				nil,             // arguments
+				ex.Args.table(), // arguments
 			)
 			if err != nil {
-				return
+				return declarationError("Exchange", ex.Name, err)
 			}
 		}
 	}
 
 	if len(config.Queues) > 0 {
 		for _, qConfig := range config.Queues {
+			if err := qConfig.validate(); err != nil {
+				return err
+			}
+
+			// queues with arguments are declared synchronously so that a queue which
+			// already exists with different arguments is reported here
+			args := qConfig.Args.table()
+			noWait := qConfig.NoWait && args == nil
 			q, err := ch.QueueDeclare(
 				qConfig.Name,           // name
 				qConfig.Durable,        // durable
 				qConfig.DeleteOnUnused, // delete when unused
 				qConfig.Exclusive,      // exclusive
-				qConfig.NoWait,         // no-wait
-				nil,                    // arguments
+				noWait,                 // no-wait
+				args,                   // arguments
 			)
 			if err != nil {
-				return err
+				return declarationError("Queue", qConfig.Name, err)
 			}
 
 			if len(qConfig.Bindings) > 0 {
@@ -155,16 +333,211 @@ func (c *MessageConsumer) Configure(ch *amqp.Channel) (err error) {
 		}
 	}
 
-	return
+	return c.declareRetryQueues(ch)
+}
+
+//DeclarationError is returned when an exchange or queue already exists with different
+//arguments. The broker will refuse it until it is deleted so reconnecting won't help
+type DeclarationError struct {
+	Kind string
+	Name string
+	Err  *amqp.Error
+}
+
+func (e *DeclarationError) Error() string {
+	return fmt.Sprintf("%s %s already exists with different arguments, it needs to be deleted so that it can be declared again (see migrate_queue_args.sh): %s", e.Kind, e.Name, e.Err.Reason)
+}
+
+//IsDeclarationError determines if the error is because an exchange or queue doesn't match the config
+func IsDeclarationError(err error) bool {
+	_, ok := err.(*DeclarationError)
+	return ok
+}
+
+// declarationError identifies a declaration the broker refused because of a mismatch
+func declarationError(kind string, name string, err error) error {
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.PreconditionFailed {
+		return &DeclarationError{Kind: kind, Name: name, Err: amqpErr}
+	}
+	return err
+}
+
+//PublishError republishes the message to the configured error exchange with headers describing the failure
+func (c *MessageConsumer) PublishError(publisher *Publisher, msg amqp.Delivery, reason string, correlationID string, errs []error) error {
+	if c.config.ErrorExchange == "" {
+		return fmt.Errorf("No error exchange has been configured")
+	}
+
+	return publisher.Publish(
+		c.config.ErrorExchange,
+		c.config.ErrorRoutingKey,
+		amqp.Publishing{
+			Headers:       errorHeaders(msg, reason, correlationID, errs),
+			ContentType:   msg.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: msg.CorrelationId,
+			MessageId:     msg.MessageId,
+			AppId:         msg.AppId,
+			Timestamp:     time.Now(),
+			Body:          msg.Body,
+		})
+}
+
+//PublishRunResult publishes the outcome of a run to the configured event exchange.
+//The routing key is the name of the event i.e BankTransferCompleted
+func (c *MessageConsumer) PublishRunResult(publisher *Publisher, result *RunResult) error {
+	if c.config.EventExchange == "" {
+		return nil
+	}
+
+	payload := result.payload()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	messageType := payload.MessageType[0]
+	routingKey := messageType[strings.LastIndex(messageType, ":")+1:]
+
+	return publisher.Publish(
+		c.config.EventExchange,
+		routingKey,
+		amqp.Publishing{
+			ContentType:   "application/vnd.masstransit+json",
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: result.CorrelationID,
+			Type:          messageType,
+			Timestamp:     time.Now(),
+			Body:          body,
+		})
+}
+
+//PublishReply sends the outcome of a run to the reply_to queue of the request
+//so that callers can wait for the result of the transfer. The reply is correlated
+//with the correlation_id of the request
+func (c *MessageConsumer) PublishReply(publisher *Publisher, msg amqp.Delivery, result *RunResult) error {
+	if msg.ReplyTo == "" || msg.CorrelationId == "" {
+		return nil
+	}
+
+	payload := result.payload()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// the default exchange routes to the queue with the same name
+	return publisher.Publish(
+		"",
+		msg.ReplyTo,
+		amqp.Publishing{
+			ContentType:   "application/vnd.masstransit+json",
+			DeliveryMode:  amqp.Transient,
+			CorrelationId: msg.CorrelationId,
+			Type:          payload.MessageType[0],
+			Timestamp:     time.Now(),
+			Body:          body,
+		})
+}
+
+// errorHeaders copies the original headers and adds the details of the failure
+func errorHeaders(msg amqp.Delivery, reason string, correlationID string, errs []error) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	errorMessages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		errorMessages = append(errorMessages, e.Error())
+	}
+
+	headers["x-pipefire-result"] = reason
+	headers["x-pipefire-errors"] = strings.Join(errorMessages, "\n")
+	headers["x-pipefire-correlation-id"] = correlationID
+	headers["x-pipefire-failed-at"] = time.Now().UTC().Format(time.RFC3339)
+	// retried messages have already been through the delay queues
+	if _, ok := headers["x-original-exchange"]; !ok {
+		headers["x-original-exchange"] = msg.Exchange
+		headers["x-original-routing-key"] = msg.RoutingKey
+	}
+
+	return headers
 }
 
 // Close Closes the connection to the rabbitmq server
 func (c *MessageConsumer) Close() error {
+	if c.Connection == nil || c.Connection.IsClosed() {
+		return nil
+	}
 	err := c.Connection.Close()
 	return err
 }
 
+// consumedQueues provides the queues the pipeline consumes messages from
+func (config BusConfig) consumedQueues() (queues []*QueueConfig) {
+	for _, q := range config.Queues {
+		if q.Consume {
+			queues = append(queues, q)
+		}
+	}
+	if len(queues) == 0 && len(config.Queues) > 0 {
+		queues = append(queues, config.Queues[0])
+	}
+	return
+}
+
+// workerCount is the number of messages which can be handled at the same time
+func (config BusConfig) workerCount() int {
+	if config.Workers < 1 {
+		return 1
+	}
+	return config.Workers
+}
+
+// claimTimeout is how long a message can be in progress before it's considered abandoned
+func (config BusConfig) claimTimeout() time.Duration {
+	if config.ClaimTimeout < 1 {
+		return defaultClaimTimeout
+	}
+	return time.Duration(config.ClaimTimeout) * time.Minute
+}
+
+// prefetchCount is the number of unacknowledged messages the broker will send to the consumer of the queue.
+// It defaults to the number of workers so that each one has a message waiting
+func (config BusConfig) prefetchCount(q *QueueConfig) int {
+	if q.PrefetchCount > 0 {
+		return q.PrefetchCount
+	}
+	if config.PrefetchCount > 0 {
+		return config.PrefetchCount
+	}
+	return config.workerCount()
+}
+
+// consumerTag identifies the consumer of the queue to the broker
+func (q QueueConfig) consumerTag() string {
+	if q.ConsumerTag != "" {
+		return q.ConsumerTag
+	}
+	return "pipefire." + q.Name
+}
+
 //ConnectionString Format an AMQP Connection String
 func (config BusConfig) ConnectionString() string {
-	return fmt.Sprintf("amqp://%s:%s@%s:%s/%s", config.User, config.Password, config.Host, config.Port, config.Vhost)
+	return config.connectionStringFor(net.JoinHostPort(config.Host, config.Port))
+}
+
+// connectionStringFor formats an AMQP Connection String for the broker at host:port
+func (config BusConfig) connectionStringFor(address string) string {
+	scheme := "amqp"
+	if config.TLS != nil && config.TLS.Enabled {
+		scheme = "amqps"
+	}
+
+	if config.authMechanism() == authExternal {
+		// the identity comes from the client certificate
+		return fmt.Sprintf("%s://%s/%s", scheme, address, config.Vhost)
+	}
+	return fmt.Sprintf("%s://%s:%s@%s/%s", scheme, config.User, config.Password, address, config.Vhost)
 }
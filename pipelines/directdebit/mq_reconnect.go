@@ -0,0 +1,118 @@
+package directdebit
+
+import (
+	"expvar"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/masenocturnal/pipefire/internal/backoff"
+)
+
+// connection lifecycle metrics, published at /debug/vars when metricsAddr is set
+var busMetrics = expvar.NewMap("rabbitmq")
+
+//ReconnectConfig defines how long to wait between attempts to reconnect to RabbitMQ
+type ReconnectConfig struct {
+	InitialDelayMs int64   `json:"initialDelayMs"`
+	MaxDelayMs     int64   `json:"maxDelayMs"`
+	Multiplier     float64 `json:"multiplier"`
+	// Jitter spreads the delay by up to this fraction of it
+	Jitter float64 `json:"jitter"`
+}
+
+func (r *ReconnectConfig) policy() backoff.Policy {
+	if r == nil {
+		// defaults
+		return backoff.Policy{
+			Initial:    2 * time.Second,
+			Max:        time.Minute,
+			Multiplier: 2,
+			Jitter:     0.2,
+		}
+	}
+	return backoff.Policy{
+		Initial:    time.Duration(r.InitialDelayMs) * time.Millisecond,
+		Max:        time.Duration(r.MaxDelayMs) * time.Millisecond,
+		Multiplier: r.Multiplier,
+		Jitter:     r.Jitter,
+	}
+}
+
+// addresses provides the host:port of each of the brokers we can connect to
+func (config BusConfig) addresses() []string {
+	hosts := config.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{config.Host}
+	}
+
+	addresses := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			// no port so use the default one
+			h = net.JoinHostPort(h, config.Port)
+		}
+		addresses = append(addresses, h)
+	}
+	return addresses
+}
+
+// address is the broker to use for the next connection attempt.
+// Each failure moves on to the next broker
+func (c *MessageConsumer) address() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	addresses := c.config.addresses()
+	return addresses[c.failures%len(addresses)]
+}
+
+// connected records that the connection is established and consuming
+func (c *MessageConsumer) connected() {
+	address := c.address()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.failures > 0 {
+		busMetrics.Add("reconnects", 1)
+		c.log.Infof("Reconnected to %s after %d attempts", address, c.failures+1)
+	}
+	c.failures = 0
+	busMetrics.Add("connects", 1)
+	busMetrics.Set("failures", intVar(0))
+	busMetrics.Set("host", stringVar(address))
+}
+
+// disconnected records a failed connection attempt or a lost connection
+func (c *MessageConsumer) disconnected(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.failures++
+	busMetrics.Add("disconnects", 1)
+	busMetrics.Set("failures", intVar(c.failures))
+	if err != nil {
+		c.log.Warnf("RabbitMQ disconnected, attempt %d: %s", c.failures, err.Error())
+	}
+}
+
+//ReconnectDelay is how long to wait before trying to connect again
+func (c *MessageConsumer) ReconnectDelay() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.config.Reconnect.policy().JitteredDelay(c.failures)
+}
+
+func intVar(i int) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(int64(i))
+	return v
+}
+
+func stringVar(s string) *expvar.String {
+	v := new(expvar.String)
+	v.Set(strings.TrimSpace(s))
+	return v
+}
@@ -0,0 +1,58 @@
+package directdebit
+
+import (
+	"fmt"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestAddresses(t *testing.T) {
+	config := BusConfig{
+		Host: "rabbit1",
+		Port: "5672",
+	}
+
+	addresses := config.addresses()
+	if len(addresses) != 1 || addresses[0] != "rabbit1:5672" {
+		t.Errorf("Expected Host to be used when Hosts is empty, got %v", addresses)
+	}
+
+	config.Hosts = []string{"rabbit2", "rabbit3:5671"}
+	addresses = config.addresses()
+	if len(addresses) != 2 || addresses[0] != "rabbit2:5672" || addresses[1] != "rabbit3:5671" {
+		t.Errorf("Unexpected addresses %v", addresses)
+	}
+}
+
+func TestReconnectRotatesHosts(t *testing.T) {
+	config := &BusConfig{
+		Port:  "5672",
+		Hosts: []string{"rabbit1", "rabbit2"},
+		Reconnect: &ReconnectConfig{
+			InitialDelayMs: 1000,
+			MaxDelayMs:     4000,
+			Multiplier:     2,
+		},
+	}
+	consumer := NewConsumer(config, log.WithField("test", "true"))
+
+	if consumer.address() != "rabbit1:5672" {
+		t.Errorf("Expected the first host, got %s", consumer.address())
+	}
+
+	consumer.disconnected(fmt.Errorf("connection refused"))
+	if consumer.address() != "rabbit2:5672" {
+		t.Errorf("Expected the second host after a failure, got %s", consumer.address())
+	}
+	consumer.disconnected(fmt.Errorf("connection refused"))
+	consumer.disconnected(fmt.Errorf("connection refused"))
+	if d := consumer.ReconnectDelay().Milliseconds(); d != 4000 {
+		t.Errorf("Expected the delay to be capped at 4000ms, got %d", d)
+	}
+
+	consumer.connected()
+	if d := consumer.ReconnectDelay().Milliseconds(); d != 1000 {
+		t.Errorf("Expected the delay to be reset to 1000ms, got %d", d)
+	}
+}
@@ -0,0 +1,179 @@
+package directdebit
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestErrorHeaders(t *testing.T) {
+
+	msg := amqp.Delivery{
+		Exchange:   "BankFileTransfer.Incoming",
+		RoutingKey: "transfer",
+		Headers: amqp.Table{
+			"x-original": "kept",
+		},
+	}
+
+	errs := []error{
+		fmt.Errorf("first"),
+		fmt.Errorf("second"),
+	}
+
+	headers := errorHeaders(msg, resultFailed, "abc-123", errs)
+
+	expected := map[string]interface{}{
+		"x-original":                "kept",
+		"x-pipefire-result":         resultFailed,
+		"x-pipefire-errors":         "first\nsecond",
+		"x-pipefire-correlation-id": "abc-123",
+		"x-original-exchange":       "BankFileTransfer.Incoming",
+		"x-original-routing-key":    "transfer",
+	}
+	for k, v := range expected {
+		if headers[k] != v {
+			t.Errorf("Header %s is %v, expected %v ", k, headers[k], v)
+		}
+	}
+
+	if _, ok := msg.Headers["x-pipefire-result"]; ok {
+		t.Error("The original message headers should not be modified")
+	}
+}
+
+func TestConsumedQueues(t *testing.T) {
+
+	config := BusConfig{
+		Queues: []*QueueConfig{
+			{Name: "BankFileTransfer.Incoming"},
+			{Name: "BankFileTransfer.Incoming_error"},
+		},
+	}
+
+	// legacy behaviour is to consume the first queue
+	queues := config.consumedQueues()
+	if len(queues) != 1 || queues[0].Name != "BankFileTransfer.Incoming" {
+		t.Errorf("Expected the first queue to be consumed got %v", queues)
+	}
+
+	config.Queues[0].Consume = true
+	config.Queues = append(config.Queues, &QueueConfig{Name: "BankFileTransfer.Resend", Consume: true, ConsumerTag: "resend"})
+	queues = config.consumedQueues()
+	if len(queues) != 2 {
+		t.Fatalf("Expected 2 queues to be consumed got %d", len(queues))
+	}
+
+	if queues[0].consumerTag() != "pipefire.BankFileTransfer.Incoming" {
+		t.Errorf("Unexpected default consumer tag %s", queues[0].consumerTag())
+	}
+	if queues[1].consumerTag() != "resend" {
+		t.Errorf("Unexpected consumer tag %s", queues[1].consumerTag())
+	}
+}
+
+func TestQueueArgs(t *testing.T) {
+
+	qConfig := &QueueConfig{}
+	if err := json.Unmarshal([]byte(`{"name": "legacy", "args": ""}`), qConfig); err != nil {
+		t.Fatalf("Legacy args should be accepted %s", err.Error())
+	}
+	if qConfig.Args.table() != nil {
+		t.Error("Legacy args should not produce arguments")
+	}
+
+	config := `{
+		"name": "BankFileTransfer.Incoming",
+		"durable": true,
+		"args": {
+			"deadLetterExchange": "BankFileTransfer.Incoming_error",
+			"messageTTL": 60000,
+			"maxLength": 100,
+			"queueType": "quorum"
+		}
+	}`
+	qConfig = &QueueConfig{}
+	if err := json.Unmarshal([]byte(config), qConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	args := qConfig.Args.table()
+	expected := amqp.Table{
+		"x-dead-letter-exchange": "BankFileTransfer.Incoming_error",
+		"x-message-ttl":          int64(60000),
+		"x-max-length":           int64(100),
+		"x-queue-type":           "quorum",
+	}
+	for k, v := range expected {
+		if args[k] != v {
+			t.Errorf("Argument %s is %v, expected %v ", k, args[k], v)
+		}
+	}
+	if err := args.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	if err := qConfig.validate(); err != nil {
+		t.Error(err)
+	}
+	qConfig.Durable = false
+	if err := qConfig.validate(); err == nil {
+		t.Error("Quorum queues which aren't durable should be rejected")
+	}
+}
+
+func TestPrefetchCount(t *testing.T) {
+
+	config := BusConfig{}
+	q := &QueueConfig{Name: "BankFileTransfer.Incoming"}
+
+	if config.workerCount() != 1 || config.prefetchCount(q) != 1 {
+		t.Errorf("Expected a single worker and prefetch of 1")
+	}
+
+	config.Workers = 4
+	if config.prefetchCount(q) != 4 {
+		t.Errorf("Prefetch should default to the number of workers, got %d", config.prefetchCount(q))
+	}
+
+	config.PrefetchCount = 2
+	if config.prefetchCount(q) != 2 {
+		t.Errorf("Expected the bus prefetch count of 2, got %d", config.prefetchCount(q))
+	}
+
+	q.PrefetchCount = 10
+	if config.prefetchCount(q) != 10 {
+		t.Errorf("Expected the queue prefetch count of 10, got %d", config.prefetchCount(q))
+	}
+}
+
+func TestPublishReplyWithoutReplyTo(t *testing.T) {
+
+	consumer := &MessageConsumer{config: &BusConfig{}}
+	result := newRunResult("d3b5e8a2-1f0c-4c6e-9a57-2b1f4e0c9d11")
+	result.finish(nil)
+
+	// not a request so there is nothing to publish to
+	if err := consumer.PublishReply(nil, amqp.Delivery{CorrelationId: result.CorrelationID}, result); err != nil {
+		t.Errorf("Expected no reply without reply_to, got %s", err.Error())
+	}
+	if err := consumer.PublishReply(nil, amqp.Delivery{ReplyTo: "amq.rabbitmq.reply-to"}, result); err != nil {
+		t.Errorf("Expected no reply without correlation_id, got %s", err.Error())
+	}
+}
+
+func TestDeclarationError(t *testing.T) {
+
+	mismatch := &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - inequivalent arg 'x-dead-letter-exchange'"}
+	err := declarationError("Queue", "BankFileTransfer.Incoming", mismatch)
+	if !IsDeclarationError(err) {
+		t.Errorf("Expected a mismatched queue not to be retried %v", err)
+	}
+
+	err = declarationError("Queue", "BankFileTransfer.Incoming", amqp.ErrClosed)
+	if IsDeclarationError(err) {
+		t.Error("Expected a closed connection to be retried")
+	}
+}
@@ -0,0 +1,101 @@
+package directdebit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// SASL mechanisms supported when connecting to RabbitMQ
+const (
+	authPlain    = "PLAIN"
+	authExternal = "EXTERNAL"
+)
+
+//TLSConfig settings for connecting to RabbitMQ over amqps
+type TLSConfig struct {
+	Enabled bool `json:"enabled"`
+	// CACert is a PEM file used to verify the broker, the system pool is used if this is empty
+	CACert string `json:"caCert"`
+	// ClientCert and ClientKey are PEM files presented to the broker
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+	// ServerName overrides the host name used to verify the broker certificate
+	ServerName string `json:"serverName"`
+	// MinVersion is one of 1.0, 1.1, 1.2 or 1.3. Defaults to 1.2
+	MinVersion string `json:"minVersion"`
+}
+
+// authMechanism is the configured mechanism in upper case, PLAIN if it isn't set
+func (config BusConfig) authMechanism() string {
+	mechanism := strings.ToUpper(strings.TrimSpace(config.AuthMechanism))
+	if mechanism == "" {
+		return authPlain
+	}
+	return mechanism
+}
+
+// externalAuth uses the identity of the client certificate to authenticate.
+// The rabbitmq_auth_mechanism_ssl plugin needs to be enabled on the broker
+type externalAuth struct{}
+
+// Mechanism returns "EXTERNAL"
+func (auth *externalAuth) Mechanism() string {
+	return authExternal
+}
+
+// Response is empty as the identity comes from the TLS handshake
+func (auth *externalAuth) Response() string {
+	return ""
+}
+
+// clientConfig builds the tls.Config used to connect to the broker
+func (t *TLSConfig) clientConfig() (*tls.Config, error) {
+	minVersion, err := tlsVersion(t.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: minVersion,
+	}
+
+	if t.CACert != "" {
+		pem, err := ioutil.ReadFile(t.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA certificate %s: %s", t.CACert, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", t.CACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if t.ClientCert != "" || t.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate %s: %s", t.ClientCert, err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func tlsVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Unsupported TLS version %s", version)
+}
@@ -0,0 +1,224 @@
+package directdebit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/masenocturnal/pipefire/internal/crypto"
+)
+
+// banks which can be selected by the trigger message
+const (
+	bankANZ = "anz"
+	bankPx  = "px"
+)
+
+var allBanks = []string{bankANZ, bankPx}
+
+// names of the parameters which can be set by the trigger message
+const (
+	paramBusinessDate = "start_date"
+	paramBanks        = "banks"
+	paramDryRun       = "dryRun"
+)
+
+// businessDatePlaceholder is replaced with the business date in the configured paths
+// i.e /tmp/ddrun/{businessDate}/Pickup
+const businessDatePlaceholder = "{businessDate}"
+
+const (
+	defaultDateFormat     = "2006-01-02"
+	defaultPathDateFormat = "20060102"
+)
+
+//ParameterSchema defines the parameters a trigger message is allowed to set.
+//Parameters which aren't allowed are rejected. Without a schema all of the
+//parameters are allowed with the default formats
+type ParameterSchema struct {
+	// Allowed is the list of parameters i.e start_date, banks, dryRun
+	Allowed []string `json:"allowed"`
+	// DateFormat is the layout of start_date, defaults to 2006-01-02
+	DateFormat string `json:"dateFormat"`
+	// PathDateFormat is the layout used to replace {businessDate} in paths, defaults to 20060102
+	PathDateFormat string `json:"pathDateFormat"`
+	// MaxDaysBack limits how old the business date can be, 0 is unlimited
+	MaxDaysBack int `json:"maxDaysBack"`
+	// Banks which can be selected, defaults to all of them
+	Banks []string `json:"banks"`
+}
+
+// defaultParameterSchema is used when the pipeline doesn't configure a schema so that a
+// message asking for a dry run or a business date is never run as a normal run
+var defaultParameterSchema = &ParameterSchema{
+	Allowed: []string{paramBusinessDate, paramBanks, paramDryRun},
+}
+
+// allows determines if the message can set the parameter
+func (s *ParameterSchema) allows(param string) bool {
+	return contains(s.Allowed, param)
+}
+
+// validate ensures the schema only refers to parameters and banks the pipeline knows about
+func (s *ParameterSchema) validate() error {
+	if s == nil {
+		return nil
+	}
+	for _, param := range s.Allowed {
+		if param != paramBusinessDate && param != paramBanks && param != paramDryRun {
+			return fmt.Errorf("Parameter schema refers to unknown parameter %s", param)
+		}
+	}
+	for _, bank := range s.Banks {
+		if !contains(allBanks, bank) {
+			return fmt.Errorf("Parameter schema refers to unknown bank %s", bank)
+		}
+	}
+	return nil
+}
+
+// request validates the parameters of the message and creates the request for the run
+func (s *ParameterSchema) request(payload *TransferFilesPayload, tasks []string) (*RunRequest, error) {
+	msg := payload.Message
+	req := &RunRequest{
+		CorrelationID:  msg.CorrelationID,
+		Tasks:          tasks,
+		PathDateFormat: defaultPathDateFormat,
+	}
+
+	if s == nil {
+		s = defaultParameterSchema
+	}
+
+	if s.PathDateFormat != "" {
+		req.PathDateFormat = s.PathDateFormat
+	}
+
+	if msg.StartDate != "" {
+		if !s.allows(paramBusinessDate) {
+			return nil, fmt.Errorf("Parameter %s is not allowed", paramBusinessDate)
+		}
+
+		format := s.DateFormat
+		if format == "" {
+			format = defaultDateFormat
+		}
+		date, err := time.ParseInLocation(format, msg.StartDate, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("Parameter %s is not a valid date: %s", paramBusinessDate, err.Error())
+		}
+
+		today := truncateDay(time.Now())
+		if date.After(today) {
+			return nil, fmt.Errorf("Business date %s is in the future", msg.StartDate)
+		}
+		if s.MaxDaysBack > 0 && date.Before(today.AddDate(0, 0, -s.MaxDaysBack)) {
+			return nil, fmt.Errorf("Business date %s is more than %d days ago", msg.StartDate, s.MaxDaysBack)
+		}
+		req.BusinessDate = date
+	}
+
+	if len(msg.Banks) > 0 {
+		if !s.allows(paramBanks) {
+			return nil, fmt.Errorf("Parameter %s is not allowed", paramBanks)
+		}
+
+		allowed := s.Banks
+		if len(allowed) == 0 {
+			allowed = allBanks
+		}
+		for _, bank := range msg.Banks {
+			bank = strings.ToLower(bank)
+			if !contains(allowed, bank) {
+				return nil, fmt.Errorf("Bank %s is not allowed", bank)
+			}
+			req.Banks = append(req.Banks, bank)
+		}
+	}
+
+	if msg.DryRun {
+		if !s.allows(paramDryRun) {
+			return nil, fmt.Errorf("Parameter %s is not allowed", paramDryRun)
+		}
+		req.DryRun = true
+	}
+
+	return req, nil
+}
+
+func truncateDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// includesBank determines if the bank has been selected for this run
+func (r *RunRequest) includesBank(bank string) bool {
+	if r == nil || len(r.Banks) == 0 {
+		return true
+	}
+	return contains(r.Banks, bank)
+}
+
+// isDryRun determines if the run should only report what it would do
+func (r *RunRequest) isDryRun() bool {
+	return r != nil && r.DryRun
+}
+
+// expand replaces the business date placeholder in the path.
+// Today is used if the message didn't specify a business date
+func (r *RunRequest) expand(path string) string {
+	if !strings.Contains(path, businessDatePlaceholder) {
+		return path
+	}
+
+	date := time.Now()
+	format := defaultPathDateFormat
+	if r != nil {
+		if !r.BusinessDate.IsZero() {
+			date = r.BusinessDate
+		}
+		if r.PathDateFormat != "" {
+			format = r.PathDateFormat
+		}
+	}
+	return strings.ReplaceAll(path, businessDatePlaceholder, date.Format(format))
+}
+
+// sftpConfig provides a copy of the task config with the paths for this run
+func (r *RunRequest) sftpConfig(conf *SftpConfig) *SftpConfig {
+	c := *conf
+	c.RemoteDir = r.expand(conf.RemoteDir)
+	c.LocalDir = r.expand(conf.LocalDir)
+	return &c
+}
+
+// encryptConfig provides a copy of the task config with the paths and banks for this run
+func (r *RunRequest) encryptConfig(conf *EncryptFilesConfig) *EncryptFilesConfig {
+	c := *conf
+	c.SrcDir = r.expand(conf.SrcDir)
+	c.OutputDir = r.expand(conf.OutputDir)
+	c.Providers = make(map[string]crypto.ProviderConfig, len(conf.Providers))
+	for bank, provider := range conf.Providers {
+		if r.includesBank(bank) {
+			c.Providers[bank] = provider
+		}
+	}
+	return &c
+}
+
+// archiveConfig provides a copy of the task config with the paths for this run
+func (r *RunRequest) archiveConfig(conf *ArchiveConfig) *ArchiveConfig {
+	c := *conf
+	c.Src = r.expand(conf.Src)
+	c.Dest = r.expand(conf.Dest)
+	return &c
+}
+
+// cleanUpConfig provides a copy of the task config with the paths for this run
+func (r *RunRequest) cleanUpConfig(conf *CleanUpConfig) *CleanUpConfig {
+	c := *conf
+	c.Paths = make([]string, 0, len(conf.Paths))
+	for _, path := range conf.Paths {
+		c.Paths = append(c.Paths, r.expand(path))
+	}
+	return &c
+}
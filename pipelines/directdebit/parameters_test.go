@@ -0,0 +1,92 @@
+package directdebit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParameterRequest(t *testing.T) {
+
+	yesterday := time.Now().AddDate(0, 0, -1).Format(defaultDateFormat)
+	payload := &TransferFilesPayload{
+		Message: MessagePayload{
+			CorrelationID: "2f1c7a64-0b8e-4f3d-9c1a-5e6d7b8a9c0d",
+			StartDate:     yesterday,
+			Banks:         []string{"ANZ"},
+			DryRun:        true,
+		},
+	}
+
+	// without a schema the parameters are still honoured
+	var none *ParameterSchema
+	req, err := none.request(payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.BusinessDate.IsZero() || !req.includesBank(bankANZ) || req.includesBank(bankPx) || !req.isDryRun() {
+		t.Errorf("Expected the parameters to be used without a schema, got %+v", req)
+	}
+	if _, err := none.request(&TransferFilesPayload{Message: MessagePayload{StartDate: "31/01/2020"}}, nil); err == nil {
+		t.Error("Expected an invalid date to be rejected without a schema")
+	}
+
+	schema := &ParameterSchema{
+		Allowed: []string{paramBusinessDate, paramBanks, paramDryRun},
+	}
+	req, err = schema.request(payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.BusinessDate.Format(defaultDateFormat) != yesterday {
+		t.Errorf("Expected business date %s, got %s", yesterday, req.BusinessDate)
+	}
+	if !req.includesBank(bankANZ) || req.includesBank(bankPx) {
+		t.Errorf("Expected only anz to be included, got %v", req.Banks)
+	}
+	if !req.isDryRun() {
+		t.Error("Expected a dry run")
+	}
+
+	invalid := []struct {
+		name   string
+		schema *ParameterSchema
+		msg    MessagePayload
+	}{
+		{"not allowed", &ParameterSchema{Allowed: []string{paramBanks}}, MessagePayload{DryRun: true}},
+		{"bad date", schema, MessagePayload{StartDate: "31/01/2020"}},
+		{"future date", schema, MessagePayload{StartDate: time.Now().AddDate(0, 0, 2).Format(defaultDateFormat)}},
+		{"too old", &ParameterSchema{Allowed: []string{paramBusinessDate}, MaxDaysBack: 7}, MessagePayload{StartDate: "2019-01-01"}},
+		{"unknown bank", schema, MessagePayload{Banks: []string{"bnz"}}},
+		{"bank not allowed", &ParameterSchema{Allowed: []string{paramBanks}, Banks: []string{bankPx}}, MessagePayload{Banks: []string{bankANZ}}},
+	}
+	for _, tt := range invalid {
+		if _, err := tt.schema.request(&TransferFilesPayload{Message: tt.msg}, nil); err == nil {
+			t.Errorf("%s: expected the parameters to be rejected", tt.name)
+		}
+	}
+
+	if err := (&ParameterSchema{Allowed: []string{"everything"}}).validate(); err == nil {
+		t.Error("Expected unknown parameters in the schema to be rejected")
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+
+	req := &RunRequest{
+		BusinessDate:   time.Date(2020, time.March, 9, 0, 0, 0, 0, time.Local),
+		PathDateFormat: defaultPathDateFormat,
+	}
+
+	if path := req.expand("/tmp/ddrun/{businessDate}/Pickup"); path != "/tmp/ddrun/20200309/Pickup" {
+		t.Errorf("Unexpected path %s", path)
+	}
+	if path := req.expand("/tmp/ddrun/Pickup"); path != "/tmp/ddrun/Pickup" {
+		t.Errorf("Paths without a placeholder shouldn't change, got %s", path)
+	}
+
+	var today *RunRequest
+	expected := "/tmp/" + time.Now().Format(defaultPathDateFormat)
+	if path := today.expand("/tmp/{businessDate}"); path != expected {
+		t.Errorf("Expected today's date %s, got %s", expected, path)
+	}
+}
@@ -0,0 +1,74 @@
+package directdebit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// how long to wait for the broker to confirm a published message
+const publishConfirmTimeout = 30 * time.Second
+
+//Publisher publishes messages on a channel in confirm mode so that
+//we know the broker has taken responsibility for them
+type Publisher struct {
+	ch          *amqp.Channel
+	confirms    chan amqp.Confirmation
+	deliveryTag uint64
+	mutex       sync.Mutex
+	log         *log.Entry
+}
+
+//NewPublisher puts the channel into confirm mode and provides a Publisher for it
+func NewPublisher(ch *amqp.Channel, log *log.Entry) (*Publisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("Unable to put the publishing channel into confirm mode: %s", err.Error())
+	}
+
+	publisher := &Publisher{
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		log:      log.WithField("Component", "Publisher"),
+	}
+	return publisher, nil
+}
+
+//Publish sends the message and waits for the broker to confirm it
+func (p *Publisher) Publish(exchange string, routingKey string, msg amqp.Publishing) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.ch.Publish(exchange, routingKey, false, false, msg); err != nil {
+		return err
+	}
+	p.deliveryTag++
+
+	timeout := time.After(publishConfirmTimeout)
+	for {
+		select {
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				return fmt.Errorf("Publishing channel closed before the message to %s was confirmed", exchange)
+			}
+			if confirm.DeliveryTag < p.deliveryTag {
+				// a late confirmation for a message we have already given up on
+				continue
+			}
+			if !confirm.Ack {
+				return fmt.Errorf("Message to %s was not acknowledged by the broker", exchange)
+			}
+			p.log.Debugf("Message to %s confirmed", exchange)
+			return nil
+		case <-timeout:
+			return fmt.Errorf("Timed out waiting for the broker to confirm the message to %s", exchange)
+		}
+	}
+}
+
+//Close closes the publishing channel
+func (p *Publisher) Close() error {
+	return p.ch.Close()
+}
@@ -0,0 +1,59 @@
+package directdebit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/masenocturnal/pipefire/internal/sftp"
+)
+
+//RetentionConfig configuration for the purgeProcessed task
+type RetentionConfig struct {
+	// ProcessedDir is the processedDir of the cleanBFP task
+	ProcessedDir string `json:"processedDir"`
+	// RetentionDays is how many days of processed files to keep
+	RetentionDays int           `json:"retentionDays"`
+	Sftp          sftp.Endpoint `json:"sftp"`
+	Enabled       bool          `json:"enabled"`
+}
+
+func (p *ddPipeline) purgeProcessed() error {
+	p.log.Info("PurgeProcessed Start")
+
+	conf := p.taskConfig.Tasks.PurgeProcessed
+	if conf == nil || !conf.Enabled {
+		p.log.Warn("PurgeProcessed Skipped")
+		return nil
+	}
+	if p.request.isDryRun() {
+		p.log.Warn("Dry run, PurgeProcessed Skipped")
+		return nil
+	}
+
+	if err := p.purgeProcessedFiles(conf, time.Now()); err != nil {
+		p.log.Errorf("Unable to purge processed files %s", err.Error())
+		return err
+	}
+	p.log.Info("PurgeProcessed Complete")
+	return nil
+}
+
+// purgeProcessedFiles removes the dated processed directories which are older than the retention period
+func (p *ddPipeline) purgeProcessedFiles(conf *RetentionConfig, now time.Time) error {
+	if conf.ProcessedDir == "" || conf.RetentionDays < 1 {
+		return fmt.Errorf("processedDir and a retentionDays of at least 1 are required to purge processed files")
+	}
+
+	conn, err := p.sftpPool.Get(conf.Sftp.Host, conf.Sftp)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	before := now.AddDate(0, 0, -conf.RetentionDays)
+	purged, err := conn.PurgeProcessed(conf.ProcessedDir, before)
+	for _, dir := range purged {
+		p.log.Infof("Purged %s", dir)
+	}
+	return err
+}
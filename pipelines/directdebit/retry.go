@@ -0,0 +1,139 @@
+package directdebit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/masenocturnal/pipefire/internal/backoff"
+	"github.com/streadway/amqp"
+)
+
+// header used to count the number of times a message has been attempted
+const attemptHeader = "x-pipefire-attempt"
+
+//RetryConfig defines how failed runs are retried.
+//Each retry is published to a delay queue which dead letters the message
+//back to the queue it was consumed from once the delay has expired
+type RetryConfig struct {
+	// MaxAttempts includes the first attempt
+	MaxAttempts    int     `json:"maxAttempts"`
+	InitialDelayMs int64   `json:"initialDelayMs"`
+	MaxDelayMs     int64   `json:"maxDelayMs"`
+	Multiplier     float64 `json:"multiplier"`
+}
+
+func (r *RetryConfig) policy() backoff.Policy {
+	return backoff.Policy{
+		Initial:    time.Duration(r.InitialDelayMs) * time.Millisecond,
+		Max:        time.Duration(r.MaxDelayMs) * time.Millisecond,
+		Multiplier: r.Multiplier,
+	}
+}
+
+// shouldRetry determines if another attempt is allowed after the given attempt failed
+func (r *RetryConfig) shouldRetry(attempt int) bool {
+	return r != nil && attempt < r.MaxAttempts
+}
+
+// retryQueueName is the delay queue used before the given retry
+func retryQueueName(queue string, retry int) string {
+	return fmt.Sprintf("%s.retry.%d", queue, retry)
+}
+
+// attempt returns which attempt this delivery is, the first delivery is attempt 1
+func attempt(msg amqp.Delivery) int {
+	switch v := msg.Headers[attemptHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 1
+}
+
+// declareRetryQueues creates a delay queue for each retry of each consumed queue
+func (c *MessageConsumer) declareRetryQueues(ch *amqp.Channel) error {
+	retry := c.config.Retry
+	if retry == nil {
+		return nil
+	}
+
+	policy := retry.policy()
+	for _, qConfig := range c.config.consumedQueues() {
+		for n := 1; n < retry.MaxAttempts; n++ {
+			args := amqp.Table{
+				"x-message-ttl": policy.Delay(n).Milliseconds(),
+				// the default exchange routes directly to the original queue
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": qConfig.Name,
+			}
+
+			_, err := ch.QueueDeclare(
+				retryQueueName(qConfig.Name, n), // name
+				true,                            // durable
+				false,                           // delete when unused
+				false,                           // exclusive
+				false,                           // no-wait
+				args,                            // arguments
+			)
+			if err != nil {
+				return declarationError("Queue", retryQueueName(qConfig.Name, n), err)
+			}
+		}
+	}
+	return nil
+}
+
+// retryUserID is set on retries when the sender is checked so that they are accepted.
+// The broker only accepts the user we are connected as, which isn't known for EXTERNAL
+func (config BusConfig) retryUserID() string {
+	if config.MessageAuth == nil || len(config.MessageAuth.AllowedUserIDs) == 0 || config.authMechanism() == authExternal {
+		return ""
+	}
+	return config.User
+}
+
+// validateRetryUser ensures retries published by pipefire will be accepted when the
+// user_id of messages is checked, otherwise every retry is moved to the error exchange
+func (config BusConfig) validateRetryUser() error {
+	if config.Retry == nil || config.MessageAuth == nil || len(config.MessageAuth.AllowedUserIDs) == 0 {
+		return nil
+	}
+	if config.authMechanism() == authExternal {
+		return fmt.Errorf("allowedUserIds can't be used with retries and %s authentication, the user retries are published as isn't known", authExternal)
+	}
+	if !contains(config.MessageAuth.AllowedUserIDs, config.User) {
+		return fmt.Errorf("allowedUserIds needs to include %s, the user retries are published as", config.User)
+	}
+	return nil
+}
+
+//PublishRetry publishes the message to the delay queue for the next attempt
+func (c *MessageConsumer) PublishRetry(publisher *Publisher, qConfig *QueueConfig, msg amqp.Delivery, correlationID string, errs []error) error {
+	return publisher.Publish(
+		"",
+		retryQueueName(qConfig.Name, attempt(msg)),
+		c.retryPublishing(msg, correlationID, errs))
+}
+
+// retryPublishing is the next attempt of the message, it's the same message so that
+// it's authenticated the same way when it's delivered again
+func (c *MessageConsumer) retryPublishing(msg amqp.Delivery, correlationID string, errs []error) amqp.Publishing {
+	headers := errorHeaders(msg, resultFailed, correlationID, errs)
+	headers[attemptHeader] = int32(attempt(msg) + 1)
+
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   msg.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		MessageId:     msg.MessageId,
+		AppId:         msg.AppId,
+		UserId:        c.config.retryUserID(),
+		Timestamp:     time.Now(),
+		Body:          msg.Body,
+	}
+}
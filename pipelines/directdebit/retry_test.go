@@ -0,0 +1,128 @@
+package directdebit
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestAttempt(t *testing.T) {
+	msg := amqp.Delivery{}
+	if attempt(msg) != 1 {
+		t.Errorf("A message without an attempt header is the first attempt")
+	}
+
+	msg.Headers = amqp.Table{attemptHeader: int32(3)}
+	if attempt(msg) != 3 {
+		t.Errorf("Expected attempt 3 got %d", attempt(msg))
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	var retry *RetryConfig
+	if retry.shouldRetry(1) {
+		t.Error("Nothing should be retried when retries aren't configured")
+	}
+
+	retry = &RetryConfig{MaxAttempts: 3}
+	if !retry.shouldRetry(1) || !retry.shouldRetry(2) {
+		t.Error("Expected attempts 1 and 2 to be retried")
+	}
+	if retry.shouldRetry(3) {
+		t.Error("Attempt 3 is the last attempt")
+	}
+}
+
+func TestRetryQueueName(t *testing.T) {
+	if n := retryQueueName("BankFileTransfer.Incoming", 2); n != "BankFileTransfer.Incoming.retry.2" {
+		t.Errorf("Unexpected retry queue name %s", n)
+	}
+}
+
+func TestRetryKeepsOriginalExchange(t *testing.T) {
+	// a retried message is delivered from the default exchange
+	msg := amqp.Delivery{
+		Exchange:   "",
+		RoutingKey: "BankFileTransfer.Incoming",
+		Headers: amqp.Table{
+			"x-original-exchange":    "BankFileTransfer.Incoming",
+			"x-original-routing-key": "transfer",
+		},
+	}
+
+	headers := errorHeaders(msg, resultFailed, "abc-123", nil)
+	if headers["x-original-exchange"] != "BankFileTransfer.Incoming" || headers["x-original-routing-key"] != "transfer" {
+		t.Errorf("The original exchange and routing key should be kept %v", headers)
+	}
+}
+
+func TestRetryUserID(t *testing.T) {
+	config := BusConfig{User: "pipefire"}
+	if userID := config.retryUserID(); userID != "" {
+		t.Errorf("Expected no user id when the sender isn't checked, got %s", userID)
+	}
+
+	config.MessageAuth = &MessageAuthConfig{AllowedUserIDs: []string{"pipefire"}}
+	if userID := config.retryUserID(); userID != "pipefire" {
+		t.Errorf("Expected the connected user, got %s", userID)
+	}
+
+	// the mechanism is case insensitive like the connection
+	for _, mechanism := range []string{"EXTERNAL", "external", " External "} {
+		config.AuthMechanism = mechanism
+		if userID := config.retryUserID(); userID != "" {
+			t.Errorf("Expected no user id with %q, got %s", mechanism, userID)
+		}
+	}
+}
+
+func TestValidateRetryUser(t *testing.T) {
+	config := BusConfig{User: "pipefire", Retry: &RetryConfig{MaxAttempts: 3}}
+	if err := config.validateRetryUser(); err != nil {
+		t.Errorf("Expected retries to be accepted when the sender isn't checked: %s", err.Error())
+	}
+
+	config.MessageAuth = &MessageAuthConfig{AllowedUserIDs: []string{"bfp"}}
+	if err := config.validateRetryUser(); err == nil {
+		t.Error("Expected the config to be rejected when retries would be refused")
+	}
+
+	config.MessageAuth.AllowedUserIDs = append(config.MessageAuth.AllowedUserIDs, "pipefire")
+	if err := config.validateRetryUser(); err != nil {
+		t.Errorf("Expected retries from an allowed user to be accepted: %s", err.Error())
+	}
+
+	config.AuthMechanism = "external"
+	if err := config.validateRetryUser(); err == nil {
+		t.Errorf("Expected the config to be rejected without knowing the retry user")
+	}
+}
+
+func TestRetryIsAuthenticated(t *testing.T) {
+	config := &BusConfig{
+		User:        "pipefire",
+		Retry:       &RetryConfig{MaxAttempts: 3},
+		MessageAuth: &MessageAuthConfig{AllowedAppIDs: []string{"bfp"}, AllowedUserIDs: []string{"bfp", "pipefire"}},
+	}
+	consumer := &MessageConsumer{config: config}
+
+	msg := amqp.Delivery{AppId: "bfp", UserId: "bfp", Body: []byte(`{}`)}
+	if err := config.MessageAuth.authenticate(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the broker delivers the retry with the properties it was published with
+	retry := consumer.retryPublishing(msg, "abc-123", nil)
+	redelivered := amqp.Delivery{
+		Headers: retry.Headers,
+		AppId:   retry.AppId,
+		UserId:  retry.UserId,
+		Body:    retry.Body,
+	}
+	if err := config.MessageAuth.authenticate(redelivered); err != nil {
+		t.Errorf("Expected the retry to be accepted: %s", err.Error())
+	}
+	if attempt(redelivered) != 2 {
+		t.Errorf("Expected the retry to be attempt 2, got %d", attempt(redelivered))
+	}
+}
@@ -0,0 +1,127 @@
+package directdebit
+
+import (
+	"fmt"
+	"time"
+)
+
+// names of the tasks which make up the pipeline, in the order they are executed
+const (
+	taskGetFilesFromBFP    = "getFilesFromBFP"
+	taskCleanBFP           = "cleanBFP"
+	taskEncryptFiles       = "encryptFiles"
+	taskSftpFilesToANZ     = "sftpFilesToANZ"
+	taskSftpFilesToPx      = "sftpFilesToPx"
+	taskArchiveTransferred = "archiveTransferred"
+	taskCleanDirtyFiles    = "cleanDirtyFiles"
+	taskPurgeProcessed     = "purgeProcessed"
+)
+
+var allTasks = []string{
+	taskGetFilesFromBFP,
+	taskCleanBFP,
+	taskEncryptFiles,
+	taskSftpFilesToANZ,
+	taskSftpFilesToPx,
+	taskArchiveTransferred,
+	taskCleanDirtyFiles,
+	taskPurgeProcessed,
+}
+
+//RouteConfig maps a message type and/or task from the trigger message to the tasks to run.
+//An empty MessageType or Task matches any value
+type RouteConfig struct {
+	MessageType string   `json:"messageType"`
+	Task        string   `json:"task"`
+	Tasks       []string `json:"tasks"`
+}
+
+//RunRequest describes a single execution of the pipeline
+type RunRequest struct {
+	CorrelationID string
+	// Tasks to execute, all tasks are executed if this is empty
+	Tasks []string
+	// BusinessDate replaces {businessDate} in the task paths, today if not set
+	BusinessDate   time.Time
+	PathDateFormat string
+	// Banks to send to, all banks are sent to if this is empty
+	Banks []string
+	// DryRun reports what would be sent without changing anything
+	DryRun bool
+}
+
+// matches determines if the route applies to the payload
+func (r *RouteConfig) matches(payload *TransferFilesPayload) bool {
+	if r.Task != "" && r.Task != payload.Message.Task {
+		return false
+	}
+	if r.MessageType == "" {
+		return true
+	}
+	for _, messageType := range payload.MessageType {
+		if messageType == r.MessageType {
+			return true
+		}
+	}
+	return false
+}
+
+// route finds the tasks to execute for the payload.
+// If no routes are configured the whole pipeline is executed
+func route(routes []*RouteConfig, payload *TransferFilesPayload) ([]string, error) {
+	if len(routes) == 0 {
+		return allTasks, nil
+	}
+
+	for _, r := range routes {
+		if r.matches(payload) {
+			return r.Tasks, nil
+		}
+	}
+	return nil, fmt.Errorf("No route for message type %v with task '%s'", payload.MessageType, payload.Message.Task)
+}
+
+// validateRoutes ensures that routes only refer to tasks the pipeline knows about
+func validateRoutes(routes []*RouteConfig) error {
+	for _, r := range routes {
+		if len(r.Tasks) == 0 {
+			return fmt.Errorf("Route for message type '%s' and task '%s' has no tasks", r.MessageType, r.Task)
+		}
+		if err := validateTasks(r.Tasks); err != nil {
+			return fmt.Errorf("Route for message type '%s' and task '%s' %s", r.MessageType, r.Task, err.Error())
+		}
+	}
+	return nil
+}
+
+// validateTasks ensures all the task names are known to the pipeline
+func validateTasks(tasks []string) error {
+	for _, t := range tasks {
+		if !isTask(t) {
+			return fmt.Errorf("refers to unknown task %s", t)
+		}
+	}
+	return nil
+}
+
+func isTask(name string) bool {
+	for _, t := range allTasks {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// includesTask determines if the task has been selected for this run
+func (r *RunRequest) includesTask(name string) bool {
+	if len(r.Tasks) == 0 {
+		return true
+	}
+	for _, t := range r.Tasks {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package directdebit
+
+import (
+	"testing"
+)
+
+const testMessageType = "urn:message:Certegy.DirectDebit.Messaging.Contracts.Payload:BankTransferPayload"
+
+func getPayload(messageType string, task string) *TransferFilesPayload {
+	return &TransferFilesPayload{
+		MessageType: []string{messageType},
+		Message: MessagePayload{
+			Task: task,
+		},
+	}
+}
+
+func TestRouteNoRoutesConfigured(t *testing.T) {
+	tasks, err := route(nil, getPayload(testMessageType, "transfer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != len(allTasks) {
+		t.Errorf("Expected all tasks to run, got %v", tasks)
+	}
+}
+
+func TestRouteByTask(t *testing.T) {
+	routes := []*RouteConfig{
+		{MessageType: testMessageType, Task: "transfer", Tasks: allTasks},
+		{MessageType: testMessageType, Task: "resend", Tasks: []string{taskSftpFilesToANZ}},
+	}
+
+	tasks, err := route(routes, getPayload(testMessageType, "resend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0] != taskSftpFilesToANZ {
+		t.Errorf("Expected only %s to run, got %v", taskSftpFilesToANZ, tasks)
+	}
+
+	if _, err := route(routes, getPayload(testMessageType, "fetchReturns")); err == nil {
+		t.Error("Expected an error for an unknown task")
+	}
+
+	if _, err := route(routes, getPayload("urn:message:Unknown", "transfer")); err == nil {
+		t.Error("Expected an error for an unknown message type")
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	valid := []*RouteConfig{
+		{Task: "resend", Tasks: []string{taskSftpFilesToANZ, taskSftpFilesToPx}},
+	}
+	if err := validateRoutes(valid); err != nil {
+		t.Error(err)
+	}
+
+	invalid := []*RouteConfig{
+		{Task: "resend", Tasks: []string{"sftpFilesToNowhere"}},
+	}
+	if err := validateRoutes(invalid); err == nil {
+		t.Error("Expected an error for an unknown task name")
+	}
+}
+
+func TestRunRequestIncludesTask(t *testing.T) {
+	req := &RunRequest{}
+	if !req.includesTask(taskCleanBFP) {
+		t.Error("All tasks should be included when none are selected")
+	}
+
+	req.Tasks = []string{taskSftpFilesToPx}
+	if req.includesTask(taskCleanBFP) || !req.includesTask(taskSftpFilesToPx) {
+		t.Errorf("Unexpected task selection for %v", req.Tasks)
+	}
+}
@@ -0,0 +1,225 @@
+package directdebit
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// message types published when a run finishes
+const (
+	messageTypeCompleted = "urn:message:Certegy.DirectDebit.Messaging.Contracts.Payload:BankTransferCompleted"
+	messageTypeFailed    = "urn:message:Certegy.DirectDebit.Messaging.Contracts.Payload:BankTransferFailed"
+	// replied to a message which was delivered again while the first run is still going
+	messageTypeInProgress = "urn:message:Certegy.DirectDebit.Messaging.Contracts.Payload:BankTransferInProgress"
+)
+
+// outcome of a file or bank transfer
+const (
+	statusSent      = "sent"
+	statusSkipped   = "skipped"
+	statusFailed    = "failed"
+	statusCompleted = "completed"
+	// the message is still being run by an earlier delivery
+	statusInProgress = "inProgress"
+	// the file would have been sent if it wasn't a dry run
+	statusDryRun = "dryRun"
+)
+
+//RunCompletedPayload is the MassTransit style envelope published when a run finishes
+type RunCompletedPayload struct {
+	MessageType []string   `json:"messageType"`
+	Message     *RunResult `json:"message"`
+}
+
+//RunResult is a summary of a pipeline run
+type RunResult struct {
+	CorrelationID string         `json:"correlationId"`
+	Status        string         `json:"status"`
+	BusinessDate  string         `json:"businessDate,omitempty"`
+	DryRun        bool           `json:"dryRun,omitempty"`
+	Duplicate     bool           `json:"duplicate,omitempty"`
+	StartTime     time.Time      `json:"startTime"`
+	EndTime       time.Time      `json:"endTime"`
+	Errors        []string       `json:"errors"`
+	Banks         []*BankOutcome `json:"banks"`
+	Files         []*FileOutcome `json:"files"`
+	mutex         sync.Mutex
+}
+
+//BankOutcome is the result of sending files to a bank
+type BankOutcome struct {
+	Bank         string `json:"bank"`
+	RemoteHost   string `json:"remoteHost"`
+	Status       string `json:"status"`
+	FilesSent    int    `json:"filesSent"`
+	FilesSkipped int    `json:"filesSkipped"`
+	FilesFailed  int    `json:"filesFailed"`
+	Error        string `json:"error,omitempty"`
+}
+
+//FileOutcome is the result of sending a single file
+type FileOutcome struct {
+	FileName   string `json:"fileName"`
+	RemoteHost string `json:"remoteHost"`
+	RemotePath string `json:"remotePath,omitempty"`
+	Size       int64  `json:"size"`
+	Hash       string `json:"hash"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newRunResult(correlationID string) *RunResult {
+	return &RunResult{
+		CorrelationID: correlationID,
+		StartTime:     time.Now(),
+		Errors:        []string{},
+		Banks:         []*BankOutcome{},
+		Files:         []*FileOutcome{},
+	}
+}
+
+// previousResult is the outcome recorded for a message which has been run before,
+// it's marked as a duplicate so that the caller can tell it's not a new run
+func previousResult(rec *ProcessedMessage) *RunResult {
+	r := newRunResult(rec.CorrelationID)
+	r.Duplicate = true
+	r.StartTime = rec.RunStart
+	if rec.RunEnd != nil {
+		r.EndTime = *rec.RunEnd
+	}
+
+	switch rec.Status {
+	case messageSucceeded:
+		r.Status = statusCompleted
+	case messageFailed:
+		r.Status = statusFailed
+		if rec.RunErrors != "" {
+			r.Errors = strings.Split(rec.RunErrors, "\n")
+		}
+	default:
+		r.Status = statusInProgress
+	}
+	return r
+}
+
+// recordFile adds the outcome of a single file transfer
+func (r *RunResult) recordFile(outcome *FileOutcome) {
+	if r == nil {
+		// tasks can be run outside of Execute
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Files = append(r.Files, outcome)
+}
+
+// recordBank summarises the files sent to the remote host of the bank
+func (r *RunResult) recordBank(bank string, remoteHost string, enabled bool, err error) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	outcome := &BankOutcome{
+		Bank:       bank,
+		RemoteHost: remoteHost,
+		Status:     statusCompleted,
+	}
+
+	if !enabled {
+		outcome.Status = statusSkipped
+		r.Banks = append(r.Banks, outcome)
+		return
+	}
+
+	for _, file := range r.Files {
+		if file.RemoteHost != remoteHost {
+			continue
+		}
+		switch file.Status {
+		case statusSent:
+			outcome.FilesSent++
+		case statusSkipped, statusDryRun:
+			outcome.FilesSkipped++
+		default:
+			outcome.FilesFailed++
+		}
+	}
+
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	if err != nil || outcome.FilesFailed > 0 {
+		outcome.Status = statusFailed
+	}
+	r.Banks = append(r.Banks, outcome)
+}
+
+// finish records the end of the run and any errors encountered
+func (r *RunResult) finish(errs []error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.EndTime = time.Now()
+	r.Status = statusCompleted
+	for _, e := range errs {
+		r.Errors = append(r.Errors, e.Error())
+	}
+	if len(r.Errors) > 0 || r.hasFailures() {
+		r.Status = statusFailed
+	}
+}
+
+// hasFailures determines if a bank or file failed, tasks can carry on when a file
+// fails so the run fails even though no error was returned
+func (r *RunResult) hasFailures() bool {
+	for _, bank := range r.Banks {
+		if bank.Status == statusFailed {
+			return true
+		}
+	}
+	for _, file := range r.Files {
+		if file.Status == statusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// failures lists the files and banks which failed, tasks can carry on when
+// a file fails so these are the reasons the run failed without an error
+func (r *RunResult) failures() []error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var errs []error
+	for _, file := range r.Files {
+		if file.Status == statusFailed {
+			errs = append(errs, fmt.Errorf("Unable to send %s to %s: %s", file.FileName, file.RemoteHost, file.Error))
+		}
+	}
+	for _, bank := range r.Banks {
+		if bank.Status == statusFailed && bank.Error != "" {
+			errs = append(errs, fmt.Errorf("Bank %s failed: %s", bank.Bank, bank.Error))
+		}
+	}
+	return errs
+}
+
+// payload wraps the result in an envelope with the message type for the outcome
+func (r *RunResult) payload() *RunCompletedPayload {
+	messageType := messageTypeFailed
+	switch r.Status {
+	case statusCompleted:
+		messageType = messageTypeCompleted
+	case statusInProgress:
+		messageType = messageTypeInProgress
+	}
+	return &RunCompletedPayload{
+		MessageType: []string{messageType},
+		Message:     r,
+	}
+}
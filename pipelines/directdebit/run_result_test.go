@@ -0,0 +1,105 @@
+package directdebit
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRunResultBankOutcome(t *testing.T) {
+
+	result := newRunResult("abc-123")
+	result.recordFile(&FileOutcome{FileName: "a.gpg", RemoteHost: "anz", Status: statusSent})
+	result.recordFile(&FileOutcome{FileName: "b.gpg", RemoteHost: "anz", Status: statusSkipped})
+	result.recordFile(&FileOutcome{FileName: "c.gpg", RemoteHost: "px", Status: statusFailed})
+
+	result.recordBank("anz", "anz", true, nil)
+	result.recordBank("px", "px", true, fmt.Errorf("Unable to connect"))
+	result.recordBank("bnz", "bnz", false, nil)
+
+	anz := result.Banks[0]
+	if anz.Status != statusCompleted || anz.FilesSent != 1 || anz.FilesSkipped != 1 {
+		t.Errorf("Unexpected outcome for anz %+v", anz)
+	}
+
+	px := result.Banks[1]
+	if px.Status != statusFailed || px.FilesFailed != 1 || px.Error == "" {
+		t.Errorf("Unexpected outcome for px %+v", px)
+	}
+
+	if result.Banks[2].Status != statusSkipped {
+		t.Errorf("Disabled bank should be skipped %+v", result.Banks[2])
+	}
+}
+
+func TestRunResultPayload(t *testing.T) {
+
+	result := newRunResult("abc-123")
+	result.finish(nil)
+	if result.payload().MessageType[0] != messageTypeCompleted {
+		t.Errorf("Expected %s ", messageTypeCompleted)
+	}
+
+	result = newRunResult("abc-123")
+	result.finish([]error{fmt.Errorf("Error getting files")})
+	if result.Status != statusFailed {
+		t.Errorf("Expected status %s got %s", statusFailed, result.Status)
+	}
+	if result.payload().MessageType[0] != messageTypeFailed {
+		t.Errorf("Expected %s ", messageTypeFailed)
+	}
+
+	// a file failed but the task carried on
+	result = newRunResult("abc-123")
+	result.recordFile(&FileOutcome{FileName: "a.gpg", RemoteHost: "anz", Status: statusFailed})
+	result.finish(nil)
+	if result.Status != statusFailed {
+		t.Errorf("Expected a failed file to fail the run, got %s", result.Status)
+	}
+
+	// a bank failed
+	result = newRunResult("abc-123")
+	result.Banks = append(result.Banks, &BankOutcome{Bank: "px", RemoteHost: "px", Status: statusFailed})
+	result.finish(nil)
+	if result.payload().MessageType[0] != messageTypeFailed {
+		t.Errorf("Expected a failed bank to publish %s ", messageTypeFailed)
+	}
+}
+
+func TestRunResultFailures(t *testing.T) {
+
+	result := newRunResult("abc-123")
+	result.recordFile(&FileOutcome{FileName: "a.gpg", RemoteHost: "anz", Status: statusSent})
+	result.recordFile(&FileOutcome{FileName: "b.gpg", RemoteHost: "anz", Status: statusFailed, Error: "Verification failed"})
+	result.recordBank("anz", "anz", true, nil)
+	result.finish(nil)
+
+	// the message is retried or moved to the error exchange based on these
+	if errs := result.failures(); result.Status != statusFailed || len(errs) != 1 {
+		t.Errorf("Expected the failed file to be the reason the run failed %v", errs)
+	}
+
+	result = newRunResult("abc-123")
+	result.recordFile(&FileOutcome{FileName: "a.gpg", RemoteHost: "anz", Status: statusSent})
+	result.finish(nil)
+	if errs := result.failures(); len(errs) != 0 {
+		t.Errorf("Expected no failures %v", errs)
+	}
+}
+
+func TestPreviousResult(t *testing.T) {
+
+	result := previousResult(&ProcessedMessage{CorrelationID: "abc-123", Status: messageInProgress})
+	if !result.Duplicate || result.payload().MessageType[0] != messageTypeInProgress {
+		t.Errorf("Expected the duplicate to be told the run is in progress %+v", result)
+	}
+
+	result = previousResult(&ProcessedMessage{CorrelationID: "abc-123", Status: messageSucceeded})
+	if result.payload().MessageType[0] != messageTypeCompleted {
+		t.Errorf("Expected the duplicate to be told the run completed %+v", result)
+	}
+
+	result = previousResult(&ProcessedMessage{CorrelationID: "abc-123", Status: messageFailed, RunErrors: "a\nb"})
+	if result.payload().MessageType[0] != messageTypeFailed || len(result.Errors) != 2 {
+		t.Errorf("Expected the duplicate to be told why the run failed %+v", result)
+	}
+}
@@ -2,9 +2,7 @@ package directdebit
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -14,6 +12,7 @@ import (
 	"time"
 
 	mysql "github.com/go-sql-driver/mysql"
+	"github.com/masenocturnal/pipefire/internal/crypto"
 	"github.com/masenocturnal/pipefire/internal/sftp"
 )
 
@@ -23,19 +22,43 @@ type SftpConfig struct {
 	LocalDir  string        `json:"localDir"`
 	Sftp      sftp.Endpoint `json:"sftp"`
 	Enabled   bool          `json:"enabled"`
+	// ProcessedDir is where cleanBFP moves the collected files to instead of deleting them.
+	// Files are moved to <processedDir>/<date>/<correlationId>/
+	ProcessedDir string `json:"processedDir"`
+	// Connection is perRun (the default) to send all the files over one connection
+	// or perFile to connect again for each file
+	Connection string `json:"connection"`
+}
+
+// connection strategies for sending files
+const (
+	connectionPerRun  = "perRun"
+	connectionPerFile = "perFile"
+)
+
+// connectPerFile determines if each file is sent over a new connection
+func (c *SftpConfig) connectPerFile() (bool, error) {
+	switch c.Connection {
+	case "", connectionPerRun:
+		return false, nil
+	case connectionPerFile:
+		return true, nil
+	default:
+		return false, fmt.Errorf("Unknown connection %s for %s, expected %s or %s", c.Connection, c.Sftp.Host, connectionPerRun, connectionPerFile)
+	}
 }
 
 // get files from a particular endpoint
 func (p *ddPipeline) sftpGet(conf *SftpConfig) error {
 	p.log.Infof("Begin sftpGet: %s ", conf.Sftp.Host)
-	sftp, err := sftp.NewConnection("From", conf.Sftp, p.log)
+	conn, err := p.sftpPool.Get("From", conf.Sftp)
 	if err != nil {
 		return err
 	}
-	defer sftp.Close()
+	defer conn.Close()
 
 	// grab all the files from the pickup directory
-	confirmations, errors := sftp.GetDir(conf.RemoteDir, conf.LocalDir)
+	confirmations, errors := conn.GetDir(conf.RemoteDir, conf.LocalDir)
 	if errors.Len() > 0 {
 		// show all errors
 		for temp := errors.Front(); temp != nil; temp = temp.Next() {
@@ -47,65 +70,71 @@ func (p *ddPipeline) sftpGet(conf *SftpConfig) error {
 	for temp := confirmations.Front(); temp != nil; temp = temp.Next() {
 		result, _ := json.MarshalIndent(temp.Value, "", " ")
 		p.log.Info(string(result))
+		if xfer, ok := temp.Value.(*sftp.FileTransferConfirmation); ok {
+			// remember what we collected so that only these files are cleaned
+			p.fetched = append(p.fetched, xfer)
+		}
 	}
 
 	p.log.Info("sftpGet Complete")
 	return err
 }
 
+// sftpList logs the files in the remote directory without collecting them
+func (p *ddPipeline) sftpList(conf *SftpConfig) error {
+	p.log.Infof("Begin sftpList: %s ", conf.Sftp.Host)
+	sftp, err := p.sftpPool.Get("From", conf.Sftp)
+	if err != nil {
+		return err
+	}
+	defer sftp.Close()
+
+	return sftp.ListRemoteDir(conf.RemoteDir)
+}
+
 // sftpClean cleans the repote directory
 func (p *ddPipeline) sftpClean(conf *SftpConfig) (err error) {
 	p.log.Infof("Begin sftpClean: %s", conf.Sftp.Host)
 	p.log.Debugf("Cleaning remote dir: %s ", conf.RemoteDir)
 
-	sftp, err := sftp.NewConnection(conf.Sftp.Host, conf.Sftp, p.log)
-	if err != nil {
-		return
+	if len(p.fetched) == 0 {
+		// files which arrived after the collection stay where they are
+		p.log.Warnf("No files were collected from %s in this run, nothing to clean", conf.RemoteDir)
+		return nil
 	}
-	defer sftp.Close()
 
-	err = sftp.CleanDir(conf.RemoteDir)
-	if err == nil {
-		p.log.Infof("sftpClean Complete: Removed files from: %s ", conf.RemoteDir)
+	if conf.ProcessedDir != "" {
+		if rel, err := filepath.Rel(conf.RemoteDir, conf.ProcessedDir); err == nil && !strings.HasPrefix(rel, "..") {
+			// we'd collect them again next time
+			return fmt.Errorf("Processed directory %s can't be inside %s", conf.ProcessedDir, conf.RemoteDir)
+		}
 	}
-	return err
-}
-
-func (p *ddPipeline) sftpToSafe(conf *SftpConfig) (err error) {
-
-	p.log.Infof("Begin sftpToSafe: %s", conf.Sftp.Host)
-	p.log.Debugf("Sftp transfer from %s to %s @ %s ", conf.LocalDir, conf.RemoteDir, conf.Sftp.Host)
 
-	// ANZ SFTP is odd and requires us to establish new connections for
-	// each load
-	filesInDir, err := ioutil.ReadDir(conf.LocalDir)
+	sftp, err := p.sftpPool.Get(conf.Sftp.Host, conf.Sftp)
 	if err != nil {
 		return
 	}
+	defer sftp.Close()
 
-	var sb strings.Builder
-	for _, file := range filesInDir {
-
-		sftp, e := sftp.NewConnection(conf.Sftp.Host, conf.Sftp, p.log)
-		if e != nil {
-			p.log.Errorf("Unable to connect to %s Error: %s ", conf.Sftp.Host, e.Error())
-			return e
+	if conf.ProcessedDir != "" {
+		processedDir := p.processedDir(conf.ProcessedDir)
+		err = sftp.MoveFetched(p.fetched, conf.RemoteDir, processedDir)
+		if err == nil {
+			p.log.Infof("sftpClean Complete: Moved %d collected files from: %s to %s", len(p.fetched), conf.RemoteDir, processedDir)
 		}
-		lfp := filepath.Join(conf.LocalDir, file.Name())
-		rfp := filepath.Join(conf.RemoteDir, file.Name())
+		return err
+	}
 
-		confirmation, err := sftp.SendFile(lfp, rfp)
-		if err != nil {
-			p.log.Errorf("Unable to Send File to %s Error: %s ", conf.Sftp.Host, err.Error())
-		}
-		result, _ := json.MarshalIndent(confirmation, "", " ")
-		sb.WriteString(string(result))
-		p.log.Info(sb.String())
-		sftp.Close()
+	err = sftp.RemoveFetched(p.fetched)
+	if err == nil {
+		p.log.Infof("sftpClean Complete: Removed %d collected files from: %s ", len(p.fetched), conf.RemoteDir)
 	}
+	return err
+}
 
-	p.log.Infof("sftpTo Complete, remote %s ", conf.RemoteDir)
-	return nil
+// processedDir is the dated directory for the files collected in this run
+func (p *ddPipeline) processedDir(root string) string {
+	return filepath.Join(root, time.Now().Format(sftp.ProcessedDateFormat), p.correlationID)
 }
 
 // send files to a particular endpoint
@@ -113,6 +142,11 @@ func (p *ddPipeline) sftpTo(conf *SftpConfig) (err error) {
 	p.log.Infof("Begin sftpTo: %s", conf.Sftp.Host)
 	p.log.Debugf("Sftp transfer from %s to %s @ %s ", conf.LocalDir, conf.RemoteDir, conf.Sftp.Host)
 
+	perFile, err := conf.connectPerFile()
+	if err != nil {
+		return err
+	}
+
 	// Record the files we are about to send so that we can ensure we never
 	// send the same file twice
 	// This is done as an atomic commit to avoid race conditions
@@ -121,13 +155,19 @@ func (p *ddPipeline) sftpTo(conf *SftpConfig) (err error) {
 	}
 
 	// establish the connection and bail if we can't get it
-	sftp, err := sftp.NewConnection(conf.Sftp.Host, conf.Sftp, p.log)
-	if err != nil {
-		return
+	// ANZ SFTP is odd and requires us to establish new connections for
+	// each file so the connection is made as each file is sent
+	var runConn sftp.Transport
+	if !perFile {
+		runConn, err = p.sftpPool.Get(conf.Sftp.Host, conf.Sftp)
+		if err != nil {
+			return
+		}
+		defer runConn.Close()
 	}
-	defer sftp.Close()
 
 	dirList, _ := ioutil.ReadDir(conf.LocalDir)
+	failed := 0
 
 	if p.transferlog == nil || p.transferlog.Conn == nil {
 		return fmt.Errorf("Transfer log is unavailable, aborting")
@@ -157,61 +197,189 @@ func (p *ddPipeline) sftpTo(conf *SftpConfig) (err error) {
 			// don't transfer the file
 			p.log.Warnf("The file %s has already been sent. File will *NOT* be transferred ", cur)
 			tx.Rollback()
+			p.result.recordFile(&FileOutcome{
+				FileName:   file.Name(),
+				RemoteHost: conf.Sftp.Host,
+				Size:       file.Size(),
+				Hash:       fileHash,
+				Status:     statusSkipped,
+			})
 		} else {
-			startTime := time.Now()
-			// attempt to transfer
-			confirmation, err := sftp.SendFile(cur, conf.RemoteDir)
-			if err != nil {
-				rec := &TransferRecord{
-					RemoteHost: conf.Sftp.Host,
-					// @todo see if this is populated TransferredFileHash: confirmation.TransferredHash,
-					TransferStart:  startTime,
-					TransferEnd:    time.Now(),
-					LocalFileHash:  fileHash,
-					CorrelationID:  p.correlationID,
-					TransferErrors: err.Error(),
+			conn := runConn
+			if perFile {
+				conn, err = p.sftpPool.GetNew(conf.Sftp.Host, conf.Sftp)
+				if err != nil {
+					// the file stays reserved and is sent by the next run
+					tx.Rollback()
+					p.log.Errorf("Unable to connect to %s Error: %s ", conf.Sftp.Host, err.Error())
+					return err
 				}
-				p.transferlog.RecordError(tx, rec)
 			}
 
-			// log the confirmation
-			result, _ := json.MarshalIndent(confirmation, "", " ")
-			p.log.Info(string(result))
-
+			startTime := time.Now()
+			// attempt to transfer
+			confirmation, err := conn.SendFile(cur, conf.RemoteDir)
 			if confirmation != nil {
+				// log the confirmation
+				result, _ := json.MarshalIndent(confirmation, "", " ")
+				p.log.Info(string(result))
+			} else {
+				p.log.Warnf("Didn't receive file transfer confirmation for %s", cur)
+				confirmation = &sftp.FileTransferConfirmation{LocalHash: fileHash}
+			}
 
-				rec := &TransferRecord{
-					RemoteFileName:      confirmation.RemoteFileName,
-					RemoteFilePath:      confirmation.RemotePath,
-					RemoteFileSize:      confirmation.RemoteSize,
-					RemoteHost:          conf.Sftp.Host,
-					RecipientName:       "",
-					SenderName:          "",
-					TransferredFileHash: confirmation.TransferredHash,
-					TransferStart:       startTime,
-					TransferEnd:         time.Now(),
-					LocalFileHash:       confirmation.LocalHash,
-					CorrelationID:       p.correlationID,
-				}
-				if err := p.transferlog.Update(tx, rec); err != nil {
-					tx.RollbackUnlessCommitted()
+			rec := &TransferRecord{
+				RemoteFileName:      confirmation.RemoteFileName,
+				RemoteFilePath:      confirmation.RemotePath,
+				RemoteFileSize:      confirmation.RemoteSize,
+				RemoteHost:          conf.Sftp.Host,
+				RecipientName:       "",
+				SenderName:          "",
+				TransferredFileHash: confirmation.TransferredHash,
+				TransferStart:       startTime,
+				TransferEnd:         time.Now(),
+				LocalFileHash:       fileHash,
+				CorrelationID:       p.correlationID,
+			}
+
+			// files written directly to their name are verified once they're there,
+			// temporary files have already been verified before they were renamed
+			if err == nil && confirmation.Verification == nil && conf.Sftp.Verify != nil {
+				confirmation.Verification, err = conn.VerifyFile(confirmation)
+				if err != nil {
+					// the bank mustn't collect a file which doesn't match
+					if rmErr := conn.RemoveFile(confirmation.RemotePath); rmErr != nil {
+						p.log.Errorf("Unable to remove %s which failed verification: %s", confirmation.RemotePath, rmErr.Error())
+					}
 				}
+			}
+			if confirmation.Verification != nil {
+				p.recordVerification(confirmation, rec, err)
+			}
+
+			var dbErr error
+			if err != nil {
+				// leave the remote size and hash empty so that the file isn't considered sent
+				rec.TransferErrors = err.Error()
+				dbErr = p.transferlog.RecordError(tx, rec)
+			} else {
+				dbErr = p.transferlog.Update(tx, rec)
+			}
+			if dbErr == nil && rec.VerificationMethod != "" {
+				dbErr = p.transferlog.RecordVerification(tx, rec)
+			}
+			if dbErr != nil {
+				p.log.Errorf("Unable to record the transfer of %s: %s", cur, dbErr.Error())
+				tx.RollbackUnlessCommitted()
+			} else {
 				tx.Commit()
+			}
 
+			outcome := &FileOutcome{
+				FileName:   file.Name(),
+				RemoteHost: conf.Sftp.Host,
+				RemotePath: confirmation.RemotePath,
+				Size:       file.Size(),
+				Hash:       fileHash,
+				Status:     statusSent,
+			}
+			if err != nil {
+				p.log.Errorf("Unable to send %s to %s: %s", cur, conf.Sftp.Host, err.Error())
+				outcome.Status = statusFailed
+				outcome.Error = err.Error()
+				failed++
 			} else {
-				p.log.Warnf("Didn't receive file transfer confirmation for %s", cur)
+				outcome.Size = confirmation.RemoteSize
 			}
+			p.result.recordFile(outcome)
 
+			if perFile {
+				conn.Close()
+			}
 		}
 	}
 
 	// try and list the directory
-	sftp.ListRemoteDir(conf.RemoteDir)
+	if runConn != nil {
+		runConn.ListRemoteDir(conf.RemoteDir)
+	}
 
+	if failed > 0 {
+		return fmt.Errorf("%d of the files could not be sent to %s", failed, conf.Sftp.Host)
+	}
 	p.log.Infof("sftpTo Complete, remote %s ", conf.RemoteDir)
 	return nil
 }
 
+// sftpDryRun records the files which would be sent without connecting to the endpoint
+func (p *ddPipeline) sftpDryRun(conf *SftpConfig) error {
+	p.log.Infof("Begin sftpDryRun: %s", conf.Sftp.Host)
+
+	dirList, err := ioutil.ReadDir(conf.LocalDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range dirList {
+		cur := filepath.Join(conf.LocalDir, file.Name())
+
+		fileHash, err := hashFile(cur)
+		if err != nil {
+			return err
+		}
+
+		status := statusDryRun
+		if p.transferlog != nil && p.transferlog.Conn != nil {
+			sent, err := p.transferlog.FileAlreadySent(p.transferlog.Conn, fileHash, conf.Sftp.Host)
+			if err != nil {
+				return err
+			}
+			if sent {
+				status = statusSkipped
+			}
+		}
+
+		if status == statusSkipped {
+			p.log.Infof("Dry run, %s has already been sent and would be skipped", cur)
+		} else {
+			p.log.Infof("Dry run, %s would be sent to %s", cur, conf.RemoteDir)
+		}
+		p.result.recordFile(&FileOutcome{
+			FileName:   file.Name(),
+			RemoteHost: conf.Sftp.Host,
+			RemotePath: conf.RemoteDir,
+			Size:       file.Size(),
+			Hash:       fileHash,
+			Status:     status,
+		})
+	}
+
+	p.log.Infof("sftpDryRun Complete, remote %s ", conf.RemoteDir)
+	return nil
+}
+
+// recordVerification adds the outcome of verifying the upload to the transfer record.
+// err is the error from sending the file which includes why the verification failed
+func (p *ddPipeline) recordVerification(confirmation *sftp.FileTransferConfirmation, rec *TransferRecord, err error) {
+	verification := confirmation.Verification
+
+	verifiedAt := time.Now()
+	rec.VerificationMethod = verification.Method
+	rec.VerifiedFileHash = verification.RemoteHash
+	rec.VerifiedAt = &verifiedAt
+	if !verification.Verified {
+		if err == nil {
+			err = fmt.Errorf("Verification of %s failed", confirmation.RemotePath)
+		}
+		p.log.Errorf("Verification of %s failed, the file has NOT been sent: %s", confirmation.RemotePath, err.Error())
+		rec.VerificationErrors = err.Error()
+		return
+	}
+
+	rec.Verified = true
+	p.log.Infof("Verified %s using %s", confirmation.RemotePath, verification.Method)
+}
+
 func (p *ddPipeline) recordFilesToSend(localDir string, remoteHost string) error {
 	// @todo validate config
 
@@ -287,14 +455,10 @@ func (p *ddPipeline) recordFilesToSend(localDir string, remoteHost string) error
 
 // @ turn into a lib
 func hashFile(filePath string) (string, error) {
-	data, err := ioutil.ReadFile(filePath)
+	// @todo inject hashwriter to support other hash algorithms
+	hash, err := crypto.HashFile(filePath)
 	if err != nil {
 		return "", fmt.Errorf("Can't hash %s bailing out. Error :  %s", filePath, err.Error())
 	}
-
-	// @todo inject hashwriter to support other hash algorithms
-	hashWriter := sha256.New()
-	// calculate local checksum
-	_, err = hashWriter.Write(data)
-	return hex.EncodeToString(hashWriter.Sum(nil)), err
+	return hash, nil
 }
@@ -39,6 +39,12 @@ type TransferRecord struct {
 	TransferEnd         time.Time
 	TransferErrors      string
 	CorrelationID       string
+	// outcome of checking the file on the remote server after the upload
+	VerificationMethod string
+	VerifiedFileHash   string
+	Verified           bool
+	VerifiedAt         *time.Time
+	VerificationErrors string
 }
 
 //TransferLog Stores a database log
@@ -92,6 +98,31 @@ func (t TransferLog) RecordError(txn *gorm.DB, rec *TransferRecord) error {
 	return nil
 }
 
+//RecordVerification Updates the transfer record with the outcome of verifying the uploaded file
+func (t TransferLog) RecordVerification(txn *gorm.DB, rec *TransferRecord) error {
+
+	sql := "local_file_hash = ? and remote_host = ? and correlation_id = ?"
+
+	result := txn.
+		Model(rec).
+		Where(sql, rec.LocalFileHash, rec.RemoteHost, rec.CorrelationID).
+		UpdateColumns(map[string]interface{}{
+			"verification_method": rec.VerificationMethod,
+			"verified_file_hash":  rec.VerifiedFileHash,
+			"verified":            rec.Verified,
+			"verified_at":         rec.VerifiedAt,
+			"verification_errors": rec.VerificationErrors,
+		})
+	if err := result.Error; err != nil {
+
+		t.log.Error(err.Error())
+		return err
+	}
+	t.log.Debugf("Rows Updated %d ", result.RowsAffected)
+
+	return nil
+}
+
 //AvailableToSend Represents a row of files
 //which have been encrypted and are available to send
 type AvailableToSend struct {